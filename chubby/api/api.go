@@ -2,14 +2,17 @@
 
 package api
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 /*
  * Shared types.
  */
 
 type ClientID string
-type FilePath 	string
+type FilePath 	string  // Chubby-style path, e.g. /ls/<cell>/dir/file
 
 // Mode of a lock
 type LockMode	int
@@ -17,8 +20,235 @@ const (
 	EXCLUSIVE LockMode = iota
 	SHARED
 	FREE
+	SEMAPHORE  // Held by up to a fixed number of clients at once.
+)
+
+// Type of a node in the namespace.
+type NodeType	int
+const (
+	FILE NodeType = iota
+	DIRECTORY
+)
+
+// Describes one child of a directory, as returned by ListDirectory.
+type DirEntry struct {
+	Name		string    // Name of the child within the directory.
+	Type		NodeType
+	Mode		LockMode  // FREE for directories.
+	Holders		int       // Number of clients holding the lock.
+	Size		int       // Size of the content in bytes.
+}
+
+// Quota usage of a directory and of the calling session. Limits of zero
+// mean no limit.
+type QuotaUsage struct {
+	Path			FilePath
+	Children		int  // Number of children of the directory.
+	MaxChildren		int
+	Bytes			int  // Total size of the files below the directory.
+	MaxBytes		int
+	OpenLocks		int  // Number of locks the session has open.
+	MaxOpenLocks	int
+}
+
+// Names of the quotas, as reported in QuotaExceededError.
+const (
+	QuotaNodesPerDir = "nodes per directory"
+	QuotaSubtreeBytes = "bytes per subtree"
+	QuotaLocksPerSession = "open locks per session"
+)
+
+// Returned when a change would take a node or session over one of its quotas.
+type QuotaExceededError struct {
+	Quota	string  // Which quota, e.g. QuotaNodesPerDir.
+	Key		string  // Directory, or client for QuotaLocksPerSession.
+	Usage	int     // Usage the change would lead to.
+	Limit	int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota of %d %s exceeded for %s: usage would be %d", e.Limit, e.Quota, e.Key, e.Usage)
+}
+
+// Returned when a value is larger than the maximum file size.
+type FileTooLargeError struct {
+	Key		string
+	Size	int
+	Limit	int
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("content for %s is %d bytes, larger than the limit of %d bytes", e.Key, e.Size, e.Limit)
+}
+
+// Part of the responses of calls that can run into a quota or the file size
+// limit. The server sends these errors here rather than as an RPC error, so
+// that the client can return them typed.
+type LimitError struct {
+	QuotaExceeded	*QuotaExceededError
+	FileTooLarge	*FileTooLargeError
+}
+
+// Returns the error carried, or nil.
+func (l LimitError) Err() error {
+	if l.QuotaExceeded != nil {
+		return l.QuotaExceeded
+	}
+	if l.FileTooLarge != nil {
+		return l.FileTooLarge
+	}
+	return nil
+}
+
+// Kinds of events a client can subscribe to. Subscriptions are bit masks,
+// e.g. CONTENT_MODIFIED | LOCK_ACQUIRED.
+type EventType int
+const (
+	CONTENT_MODIFIED EventType = 1 << iota  // The file's content changed.
+	CHILD_ADDED                             // A node was created in the directory.
+	CHILD_REMOVED                           // A node was deleted from the directory.
+	LOCK_ACQUIRED                           // A client acquired the file's lock.
+	CONFLICTING_LOCK_REQUEST                // A client asked for the lock and could not get it.
+	MASTER_FAILOVER                         // A new master took over; cached state may be stale.
+)
+
+// An event delivered to a subscribed client.
+type Event struct {
+	Type		EventType
+	Filepath	FilePath  // Node the client subscribed to.
+	Child		FilePath  // Node added or removed, for CHILD_ADDED and CHILD_REMOVED.
+}
+
+// A change seen by Watch, tagged with the Raft log index of the command that
+// made it. For CHILD_ADDED and CHILD_REMOVED, Child is the node created or
+// deleted.
+type WatchEvent struct {
+	Index	uint64
+	Event	Event
+}
+
+// One match of Find.
+type FindEntry struct {
+	Path	FilePath
+	Stat	NodeStat
+}
+
+// Metadata of a file or directory, as returned by Stat.
+type NodeStat struct {
+	Type				NodeType
+	InstanceNumber		uint64     // Greater than that of any earlier node with the same name.
+	ContentGeneration	uint64     // Bumped on every write of the content.
+	LockGeneration		uint64     // Bumped every time the lock goes from free to held, and on upgrades.
+	ACLGeneration		uint64     // Bumped on every change of the ACLs.
+	Created				time.Time
+	Modified			time.Time
+	Size				int        // Size of the content in bytes.
+	Checksum			uint64     // CRC-64 of the content.
+	ACL					ACL
+	Ephemeral			bool       // Deleted once no session has it open.
+	Mandatory			bool       // Reading requires holding the lock.
+}
+
+// Names the ACL files of a node. An ACL file lists the clients it allows,
+// one per line; "*" allows every client. An empty name allows every client.
+// New nodes start with the ACL names of their parent directory.
+type ACL struct {
+	Read		FilePath  // May read the content and metadata, and hold SHARED locks.
+	Write		FilePath  // May write, delete, create children and hold EXCLUSIVE locks.
+	ChangeACL	FilePath  // May change the ACL names.
+}
+
+// Permission checked against one of the ACLs of a node.
+type Permission int
+const (
+	READ Permission = iota
+	WRITE
+	CHANGE_ACL
+)
+
+// Access requested when opening a handle. ACLs are checked once, at Open;
+// operations through the handle then need the matching access.
+type OpenMode int
+const (
+	OPEN_READ OpenMode = 1 << iota  // Read content and metadata, list, subscribe, hold SHARED locks.
+	OPEN_WRITE                      // Write, delete, rename, hold EXCLUSIVE locks.
+	OPEN_CHANGE_ACL                 // Change the ACL names and the mandatory flag.
+)
+
+// Options for opening a handle.
+type OpenFlag int
+const (
+	OPEN_CREATE OpenFlag = 1 << iota  // Create the file if it does not exist.
+	OPEN_EPHEMERAL                    // If the file is created, delete it once no session has it open.
+)
+
+// A handle on an open file or directory, returned by Open. The check digits
+// are computed by the master over the other fields, so that a handle cannot
+// be forged or altered.
+type Handle struct {
+	ClientID	ClientID
+	ID			uint64
+	Path		FilePath
+	Instance	uint64    // Instance number of the node opened.
+	Mode		OpenMode  // Access granted when the handle was opened.
+	CheckDigits	uint64
+}
+
+// One lock requested as part of TryAcquireLocks.
+type LockRequest struct {
+	Handle	Handle
+	Mode	LockMode
+}
+
+// Policy for scheduling SHARED and EXCLUSIVE requests on a lock.
+type LockPolicy	int
+const (
+	// Once an EXCLUSIVE request is queued, new SHARED requests wait behind it.
+	WRITER_PREFERRING LockPolicy = iota
+	// SHARED requests are granted whenever the lock is not held exclusively.
+	READER_PREFERRING
+	// Requests are granted strictly in the order they arrive.
+	STRICT_FIFO
 )
 
+// A sequencer describes a lock held by a client. Clients pass it to other
+// servers, which call CheckSequencer to make sure the lock is still held
+// before acting on a request (fencing).
+type Sequencer struct {
+	LockName	FilePath
+	Mode		LockMode
+	Generation	uint64    // Lock generation number when the sequencer was issued.
+	Holder		ClientID  // Client the sequencer was issued to.
+}
+
+// Kind of condition checked by a transaction before it applies.
+type TxnGuardType int
+const (
+	GUARD_EXISTS TxnGuardType = iota  // The file or directory exists.
+	GUARD_GENERATION                  // The file's content generation equals Generation.
+	GUARD_LOCK_HELD                   // The calling client holds the file's lock.
+)
+
+type TxnGuard struct {
+	Type		TxnGuardType
+	Filepath	FilePath
+	Generation	uint64
+}
+
+// Kind of operation applied by a transaction.
+type TxnOpType int
+const (
+	TXN_CREATE TxnOpType = iota  // Create a file that does not exist yet.
+	TXN_SET                      // Write the content of an existing file, whose lock the caller holds.
+	TXN_DELETE                   // Delete an existing file, whose lock the caller holds in EXCLUSIVE mode.
+)
+
+type TxnOp struct {
+	Type		TxnOpType
+	Filepath	FilePath
+	Content		[]byte  // For TXN_CREATE and TXN_SET.
+}
+
 /*
  * RPC interfaces.
  */
@@ -34,35 +264,151 @@ type KeepAliveRequest struct {
 	ClientID ClientID
 	// Session information:
 	Locks		map[FilePath]LockMode  // Locks held by the client.
+	Subscriptions	map[FilePath]EventType  // Events the client subscribed to.
+	Handles		[]Handle  // Handles the client has open.
+	InvalidationAcks	[]FilePath  // Files dropped from the cache since the last KeepAlive.
 }
 
 type KeepAliveResponse struct {
 	LeaseLength time.Duration
+	Events []Event  // Events since the last KeepAlive.
+	Invalidations []FilePath  // Files to drop from the cache, then acknowledge.
 }
 
 // TODO: make all fields exported
 
-type OpenLockRequest struct {
+type OpenRequest struct {
 	ClientID ClientID
 	Filepath FilePath
+	Mode OpenMode
+	Flags OpenFlag
+	Capacity int  // If the file is created and this is positive, it is a semaphore with this many slots.
 }
 
-type OpenLockResponse struct {
+type OpenResponse struct {
+	Handle Handle
+	LimitError
+}
 
+type CloseRequest struct {
+	ClientID ClientID
+	Handle Handle
 }
 
-type DeleteLockRequest struct {
+type CloseResponse struct {
+
+}
+
+type CreateDirectoryRequest struct {
 	ClientID ClientID
 	Filepath FilePath
 }
 
+type CreateDirectoryResponse struct {
+	LimitError
+}
+
+type DeleteDirectoryRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type DeleteDirectoryResponse struct {
+
+}
+
+type DeleteRecursiveRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Force bool  // Delete even if locks in the subtree are held, releasing them.
+}
+
+type DeleteRecursiveResponse struct {
+
+}
+
+type RenameRequest struct {
+	ClientID ClientID
+	Handle Handle
+	NewFilepath FilePath
+	Force bool  // Move even if locks in the subtree are held, releasing them.
+}
+
+type RenameResponse struct {
+	LimitError
+}
+
+type ListDirectoryRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type ListDirectoryResponse struct {
+	Entries []DirEntry
+}
+
+type FindRequest struct {
+	ClientID ClientID
+	Pattern string  // Path prefix, or glob such as /ls/local/job/lock_*
+}
+
+type FindResponse struct {
+	Entries []FindEntry
+}
+
+type GetQuotaUsageRequest struct {
+	ClientID ClientID
+	Handle Handle  // Directory whose usage to report.
+}
+
+type GetQuotaUsageResponse struct {
+	Usage QuotaUsage
+}
+
+type SubscribeRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Events EventType  // Events to deliver for the node; 0 unsubscribes.
+}
+
+type SubscribeResponse struct {
+
+}
+
+type WatchRequest struct {
+	ClientID ClientID
+	Prefix string  // Report changes to nodes whose path starts with Prefix.
+	FromIndex uint64  // Report changes after this log index.
+	Timeout time.Duration  // How long to wait for a change.
+}
+
+type WatchResponse struct {
+	Events []WatchEvent
+	NextIndex uint64  // FromIndex for the next Watch call.
+	Compacted bool  // The history no longer reaches back to FromIndex.
+}
+
+type StatRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type StatResponse struct {
+	Stat NodeStat
+}
+
+type DeleteLockRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
 type DeleteLockResponse struct {
 
 }
 
 type TryAcquireLockRequest struct {
 	ClientID ClientID
-	Filepath FilePath
+	Handle Handle
 	Mode LockMode
 }
 
@@ -70,30 +416,162 @@ type TryAcquireLockResponse struct {
 	IsSuccessful bool
 }
 
+type TryAcquireLocksRequest struct {
+	ClientID ClientID
+	Locks []LockRequest
+}
+
+type TryAcquireLocksResponse struct {
+	IsSuccessful bool
+}
+
+type AcquireLockRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Mode LockMode
+	Timeout time.Duration  // How long to wait for the lock.
+}
+
+type AcquireLockResponse struct {
+	IsSuccessful bool
+}
+
 type ReleaseLockRequest struct {
 	ClientID ClientID
-	Filepath FilePath
+	Handle Handle
 }
 
 type ReleaseLockResponse struct {
 
 }
 
+type SetLockPolicyRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Policy LockPolicy
+}
+
+type SetLockPolicyResponse struct {
+
+}
+
+type UpgradeLockRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Timeout time.Duration  // How long to wait for other holders to release.
+}
+
+type UpgradeLockResponse struct {
+	IsSuccessful bool
+}
+
+type DowngradeLockRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type DowngradeLockResponse struct {
+
+}
+
+type SetLockDelayRequest struct {
+	ClientID ClientID
+	Handle Handle
+	LockDelay time.Duration
+}
+
+type SetLockDelayResponse struct {
+
+}
+
+type GetSequencerRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type GetSequencerResponse struct {
+	Sequencer Sequencer
+}
+
+type CheckSequencerRequest struct {
+	ClientID ClientID
+	Sequencer Sequencer
+}
+
+type CheckSequencerResponse struct {
+	IsValid bool
+}
+
+type GetACLRequest struct {
+	ClientID ClientID
+	Handle Handle
+}
+
+type GetACLResponse struct {
+	ACL ACL
+}
+
+type SetACLRequest struct {
+	ClientID ClientID
+	Handle Handle
+	ACL ACL
+}
+
+type SetACLResponse struct {
+
+}
+
+type SetMandatoryRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Mandatory bool
+}
+
+type SetMandatoryResponse struct {
+
+}
+
+type TxnRequest struct {
+	ClientID ClientID
+	Guards []TxnGuard
+	Ops []TxnOp
+}
+
+type TxnResponse struct {
+	IsSuccessful bool  // False if a guard did not hold; nothing was applied.
+	LimitError
+}
+
 type ReadRequest struct {
 	ClientID ClientID
-	Filepath FilePath
+	Handle Handle
 }
 
 type ReadResponse struct {
-	Content string
+	Content []byte
+	Cacheable bool  // The client may cache Content until it is invalidated.
 }
 
 type WriteRequest struct {
 	ClientID ClientID
-	Filepath FilePath
-	Content string
+	Handle Handle
+	Content []byte
 }
 
 type WriteResponse struct {
 	IsSuccessful bool
+	LimitError
+}
+
+type CompareAndSetRequest struct {
+	ClientID ClientID
+	Handle Handle
+	Content []byte
+	ExpectedGeneration uint64  // Content generation the file must still have.
+}
+
+type CompareAndSetResponse struct {
+	IsSuccessful bool
+	ContentGeneration uint64  // New content generation if successful.
+	LimitError
 }
\ No newline at end of file
@@ -0,0 +1,107 @@
+// Client-side cache of file contents, as in Chubby.
+//
+// Reads are served locally once the master has said the content is
+// cacheable. Before a write commits, the master sends invalidations with
+// KeepAlive responses, and the cached copies are dropped and acknowledged
+// with the next KeepAlive request. If the session falls into jeopardy the
+// master may write without waiting for us, so the whole cache is flushed.
+
+package client
+
+import (
+	"cos518project/chubby/api"
+	"strings"
+)
+
+// Return a copy of the cached content of a file, if any.
+func (sess *ClientSession) cachedContent(filePath api.FilePath) ([]byte, bool) {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	content, ok := sess.cache[filePath]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), content...), true
+}
+
+// Return the current cache generation. Content read from the master may only
+// be cached if no invalidation arrived since, i.e. the generation is unchanged.
+func (sess *ClientSession) cacheGeneration() uint64 {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	return sess.cacheGen
+}
+
+// Cache the content of a file read when the cache was at generation gen.
+func (sess *ClientSession) cacheContent(filePath api.FilePath, content []byte, gen uint64) {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	if sess.cacheGen != gen {
+		return
+	}
+	sess.cache[filePath] = append([]byte(nil), content...)
+}
+
+// Drop the files invalidated by the master, and acknowledge them with the
+// next KeepAlive.
+func (sess *ClientSession) invalidate(paths []api.FilePath) {
+	if len(paths) == 0 {
+		return
+	}
+
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	for _, path := range paths {
+		delete(sess.cache, path)
+	}
+	sess.cacheGen++
+	sess.invalidationAcks = append(sess.invalidationAcks, paths...)
+}
+
+// Remove and return the invalidations to acknowledge.
+func (sess *ClientSession) takeInvalidationAcks() []api.FilePath {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	acks := sess.invalidationAcks
+	sess.invalidationAcks = nil
+	return acks
+}
+
+// Drop our own cached copy of a file we are writing. The master does not
+// send invalidations to the writer.
+func (sess *ClientSession) uncache(filePath api.FilePath) {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	delete(sess.cache, filePath)
+	sess.cacheGen++
+}
+
+// Drop our own cached copies of files at or below filePath.
+func (sess *ClientSession) uncacheSubtree(filePath api.FilePath) {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	for path := range sess.cache {
+		if path == filePath || strings.HasPrefix(string(path), string(filePath) + "/") {
+			delete(sess.cache, path)
+		}
+	}
+	sess.cacheGen++
+}
+
+// Drop the whole cache. A new master knows nothing of pending invalidations,
+// so there is nothing left to acknowledge.
+func (sess *ClientSession) flushCache() {
+	sess.cacheMu.Lock()
+	defer sess.cacheMu.Unlock()
+
+	sess.cache = make(map[api.FilePath][]byte)
+	sess.cacheGen++
+	sess.invalidationAcks = nil
+}
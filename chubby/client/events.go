@@ -0,0 +1,111 @@
+// Chubby events: the client subscribes to events on a node, the server
+// returns matching events with KeepAlive responses, and the client library
+// runs the callbacks registered for them.
+
+package client
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Events subscribed to on one node.
+type subscription struct {
+	events		api.EventType
+	callback	func(api.Event)
+}
+
+// Subscribe to events on the node a handle is open on, such as
+// api.CONTENT_MODIFIED | api.LOCK_ACQUIRED, replacing any earlier
+// subscription on the node. callback runs for each event, one event at a
+// time and in the order the events arrived. Subscribing to no events
+// unsubscribes; so does closing the last handle on the node.
+func (sess *ClientSession) Subscribe(handle api.Handle, events api.EventType, callback func(api.Event)) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	if events != 0 && callback == nil {
+		return errors.New("Subscribing to events needs a callback")
+	}
+
+	req := api.SubscribeRequest{ClientID: sess.clientID, Handle: handle, Events: events}
+	resp := &api.SubscribeResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Subscribe", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	sess.subscriptionMu.Lock()
+	defer sess.subscriptionMu.Unlock()
+	if events == 0 {
+		delete(sess.subscriptions, handle.Path)
+	} else {
+		sess.subscriptions[handle.Path] = &subscription{events: events, callback: callback}
+	}
+	return nil
+}
+
+// Returns the events subscribed to on each node, to send to a new master.
+func (sess *ClientSession) subscribedEvents() map[api.FilePath]api.EventType {
+	sess.subscriptionMu.Lock()
+	defer sess.subscriptionMu.Unlock()
+
+	events := make(map[api.FilePath]api.EventType)
+	for filePath, sub := range sess.subscriptions {
+		events[filePath] = sub.events
+	}
+	return events
+}
+
+// Hand events from a KeepAlive response to the dispatcher. This runs on the
+// KeepAlive loop, so it must not wait for slow callbacks: if the queue is
+// full, the event is dropped and counted in DroppedEvents.
+func (sess *ClientSession) queueEvents(events []api.Event) {
+	for _, event := range events {
+		select {
+		case sess.eventChan <- event:
+		default:
+			dropped := atomic.AddUint64(&sess.droppedEvents, 1)
+			sess.logger.Printf("Event queue full: dropped event %d on %s (%d dropped so far)", event.Type, event.Filepath, dropped)
+		}
+	}
+}
+
+// Run the callbacks for each event, in order. A master-failover event goes
+// to every subscription that asked for it.
+func (sess *ClientSession) dispatchEvents() {
+	for event := range sess.eventChan {
+		sess.subscriptionMu.Lock()
+		var callbacks []func(api.Event)
+		for filePath, sub := range sess.subscriptions {
+			if sub.events & event.Type == 0 {
+				continue
+			}
+			if event.Type == api.MASTER_FAILOVER || filePath == event.Filepath {
+				callbacks = append(callbacks, sub.callback)
+			}
+		}
+		sess.subscriptionMu.Unlock()
+
+		for _, callback := range callbacks {
+			callback(event)
+		}
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"net/rpc"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,6 +33,36 @@ type ClientSession struct {
 	// Locks held by the session
 	locks				map[api.FilePath]api.LockMode
 
+	// Open handles by ID.
+	handles				map[uint64]api.Handle
+
+	// Protects handles.
+	handleMu			sync.Mutex
+
+	// Events subscribed to on each node, and the callbacks to run for them.
+	subscriptions		map[api.FilePath]*subscription
+
+	// Protects subscriptions.
+	subscriptionMu		sync.Mutex
+
+	// Events waiting to be dispatched to callbacks, in order.
+	eventChan			chan api.Event
+
+	// Events dropped because eventChan was full; see queueEvents.
+	droppedEvents		uint64
+
+	// Cached file contents; see cache.go.
+	cache				map[api.FilePath][]byte
+
+	// Bumped whenever cached content is dropped.
+	cacheGen			uint64
+
+	// Invalidated files to acknowledge with the next KeepAlive.
+	invalidationAcks	[]api.FilePath
+
+	// Protects cache, cacheGen and invalidationAcks.
+	cacheMu				sync.Mutex
+
 	// Are we in jeopardy right now?
 	jeopardyFlag		bool
 
@@ -55,6 +88,10 @@ func InitSession(clientID api.ClientID) (*ClientSession, error) {
 		startTime:    time.Now(),
 		leaseLength:  DefaultLeaseDuration,
 		locks:		  make(map[api.FilePath]api.LockMode),
+		handles:      make(map[uint64]api.Handle),
+		subscriptions: make(map[api.FilePath]*subscription),
+		eventChan:    make(chan api.Event, 100),
+		cache:        make(map[api.FilePath][]byte),
 		jeopardyFlag: false,
 		jeopardyChan: make(chan struct{}, 2),
 		expired:      false,
@@ -103,6 +140,10 @@ func InitSession(clientID api.ClientID) (*ClientSession, error) {
 	// Call MonitorSession.
 	go sess.MonitorSession()
 
+	// Run event callbacks in their own goroutine, so that a slow callback
+	// cannot hold up KeepAlives.
+	go sess.dispatchEvents()
+
 	return sess, nil
 }
 
@@ -123,7 +164,7 @@ func (sess *ClientSession) MonitorSession() {
 				}
 			}()
 
-			req := api.KeepAliveRequest{ClientID: sess.clientID}
+			req := api.KeepAliveRequest{ClientID: sess.clientID, InvalidationAcks: sess.takeInvalidationAcks()}
 			resp := &api.KeepAliveResponse{}
 
 			sess.logger.Printf("Sending KeepAlive to server %s", sess.serverAddr)
@@ -148,10 +189,14 @@ func (sess *ClientSession) MonitorSession() {
 			sess.logger.Printf("KeepAlive response from %s received within lease timeout", sess.serverAddr)
 
 			// Adjust new lease length.
-			if (sess.leaseLength >= resp.LeaseLength) {
+			// Responses returned early to deliver events or invalidations
+			// keep the same lease.
+			if (sess.leaseLength >= resp.LeaseLength && len(resp.Events) == 0 && len(resp.Invalidations) == 0) {
 				sess.logger.Printf("WARNING: new lease length shorter than current lease length")
 			}
 			sess.leaseLength = resp.LeaseLength
+			sess.invalidate(resp.Invalidations)
+			sess.queueEvents(resp.Events)
 
 		case <- time.After(durationLeaseOver):
 			// Jeopardy period begins
@@ -160,6 +205,10 @@ func (sess *ClientSession) MonitorSession() {
 			sess.jeopardyFlag = true
 			sess.logger.Printf("session with %s in jeopardy", sess.serverAddr)
 
+			// The master stops waiting for our acknowledgments once our
+			// lease is over, so nothing cached can be trusted any more.
+			sess.flushCache()
+
 			// In a new goroutine, try to send KeepAlives to every server.
 			// KeepAlive should check if the node is the master -> if not, ignore.
 			// In KeepAlive request, eagerly send session information to server (leaseLength, locks)
@@ -182,6 +231,8 @@ func (sess *ClientSession) MonitorSession() {
 					sess.logger.Printf("Add lock %s to KeepAlive session info", filePath)
 					req.Locks[filePath] = lockMode
 				}
+				req.Subscriptions = sess.subscribedEvents()
+				req.Handles = sess.openHandles()
 
 				resp := &api.KeepAliveResponse{}
 
@@ -254,6 +305,8 @@ func (sess *ClientSession) MonitorSession() {
 					sess.logger.Printf("WARNING: new lease length shorter than current lease length")
 				}
 				sess.leaseLength = resp.LeaseLength
+				sess.invalidate(resp.Invalidations)
+				sess.queueEvents(resp.Events)
 
 				// Unblock all requests.
 				sess.jeopardyFlag = false
@@ -277,37 +330,449 @@ func (sess *ClientSession) MonitorSession() {
 
 // Current plan is to implement a function for each Chubby library call.
 // Each function should check jeopardyFlag to see if call should be blocked.
-func (sess *ClientSession) OpenLock(filePath api.FilePath) error {
+
+// Open a handle on a file or directory with the given access. With
+// api.OPEN_CREATE, a file that does not exist is created. Operations on the
+// node go through the handle.
+func (sess *ClientSession) Open(filePath api.FilePath, mode api.OpenMode, flags api.OpenFlag) (api.Handle, error) {
+	return sess.open(api.OpenRequest{ClientID: sess.clientID, Filepath: filePath, Mode: mode, Flags: flags})
+}
+
+// Open a lock for reading and writing, creating it if it does not exist.
+func (sess *ClientSession) OpenLock(filePath api.FilePath) (api.Handle, error) {
+	return sess.open(api.OpenRequest{ClientID: sess.clientID, Filepath: filePath, Mode: api.OPEN_READ | api.OPEN_WRITE, Flags: api.OPEN_CREATE})
+}
+
+// Open a semaphore that up to capacity clients may hold at once
+// in api.SEMAPHORE mode.
+func (sess *ClientSession) OpenSemaphore(filePath api.FilePath, capacity int) (api.Handle, error) {
+	return sess.open(api.OpenRequest{ClientID: sess.clientID, Filepath: filePath, Mode: api.OPEN_READ | api.OPEN_WRITE, Flags: api.OPEN_CREATE, Capacity: capacity})
+}
+
+// Open a lock, creating it as an ephemeral file if it does not exist. The
+// server deletes it once no session has it open, e.g. when this session ends.
+func (sess *ClientSession) OpenEphemeralLock(filePath api.FilePath) (api.Handle, error) {
+	return sess.open(api.OpenRequest{ClientID: sess.clientID, Filepath: filePath, Mode: api.OPEN_READ | api.OPEN_WRITE, Flags: api.OPEN_CREATE | api.OPEN_EPHEMERAL})
+}
+
+func (sess *ClientSession) open(req api.OpenRequest) (api.Handle, error) {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
 		case <-sess.jeopardyChan:
 			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
 		case <-time.After(durationJeopardyOver):
-			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+			return api.Handle{}, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
 		}
 	}
-	sess.logger.Printf("Sending OpenLock request to server %s", sess.serverAddr)
-	req := api.OpenLockRequest{ClientID: sess.clientID, Filepath: filePath}
-	resp := &api.OpenLockResponse{}
+	sess.logger.Printf("Sending Open request to server %s", sess.serverAddr)
+	resp := &api.OpenResponse{}
 
 	var err error
 	for {  // If we get a connection problem, keep trying.
-		err = sess.rpcClient.Call("Handler.OpenLock", req, resp)
+		err = sess.rpcClient.Call("Handler.Open", req, resp)
 		if err != io.ErrUnexpectedEOF {
 			break
 		}
 	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
 
 	if err != nil {
-		sess.logger.Printf("OpenLock with server %s failed with error %s", sess.serverAddr, err.Error())
-	} else {
-		sess.logger.Printf("Open Lock successfully at filepath %s in session with %s", filePath, sess.serverAddr)
+		sess.logger.Printf("Open with server %s failed with error %s", sess.serverAddr, err.Error())
+		return api.Handle{}, err
+	}
+	sess.logger.Printf("Opened handle %d at filepath %s in session with %s", resp.Handle.ID, req.Filepath, sess.serverAddr)
+
+	sess.handleMu.Lock()
+	sess.handles[resp.Handle.ID] = resp.Handle
+	sess.handleMu.Unlock()
+	return resp.Handle, nil
+}
+
+// Close a handle. Closing the last handle on a file releases its lock, if
+// held, and ends the subscriptions made through the handle.
+func (sess *ClientSession) Close(handle api.Handle) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.CloseRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.CloseResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Close", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	sess.handleMu.Lock()
+	defer sess.handleMu.Unlock()
+	delete(sess.handles, handle.ID)
+	for _, other := range sess.handles {
+		if other.Path == handle.Path {
+			return nil
+		}
+	}
+	delete(sess.locks, handle.Path)
+	sess.subscriptionMu.Lock()
+	delete(sess.subscriptions, handle.Path)
+	sess.subscriptionMu.Unlock()
+	return nil
+}
+
+// Handles to re-establish with a new master.
+func (sess *ClientSession) openHandles() []api.Handle {
+	sess.handleMu.Lock()
+	defer sess.handleMu.Unlock()
+
+	handles := make([]api.Handle, 0, len(sess.handles))
+	for _, handle := range sess.handles {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// Create a directory if it does not exist. Its parent directory must exist.
+func (sess *ClientSession) CreateDirectory(filePath api.FilePath) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.CreateDirectoryRequest{ClientID: sess.clientID, Filepath: filePath}
+	resp := &api.CreateDirectoryResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.CreateDirectory", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
+	return err
+}
+
+// Delete an empty directory.
+func (sess *ClientSession) DeleteDirectory(handle api.Handle) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.DeleteDirectoryRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.DeleteDirectoryResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.DeleteDirectory", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return err
+}
+
+// List the children of a directory with their type, lock mode, number of
+// holders and content size.
+func (sess *ClientSession) ListDirectory(handle api.Handle) ([]api.DirEntry, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return nil, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.ListDirectoryRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.ListDirectoryResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.ListDirectory", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return resp.Entries, err
+}
+
+// Delete the file or directory the handle is open on, with everything below
+// it. Unless force is set, fails if any lock in the subtree is held; forcing
+// releases those locks.
+func (sess *ClientSession) DeleteRecursive(handle api.Handle, force bool) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.DeleteRecursiveRequest{ClientID: sess.clientID, Handle: handle, Force: force}
+	resp := &api.DeleteRecursiveResponse{}
+	sess.uncacheSubtree(handle.Path)
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.DeleteRecursive", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err == nil {
+		sess.forgetSubtree(handle.Path)
 	}
 	return err
 }
 
-func (sess *ClientSession) DeleteLock(filePath api.FilePath) error {
+// Move the file or directory the handle is open on, with everything below
+// it, to newFilePath, which must not exist yet. Content, metadata and locks
+// move along. Unless force is set, fails if any lock in the subtree is held;
+// forcing releases those locks.
+func (sess *ClientSession) Rename(handle api.Handle, newFilePath api.FilePath, force bool) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.RenameRequest{ClientID: sess.clientID, Handle: handle, NewFilepath: newFilePath, Force: force}
+	resp := &api.RenameResponse{}
+	sess.uncacheSubtree(handle.Path)
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Rename", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
+	if err == nil {
+		sess.forgetSubtree(handle.Path)
+	}
+	return err
+}
+
+// Forget locks at or below handle.Path: a forced delete or rename released them.
+func (sess *ClientSession) forgetSubtree(filePath api.FilePath) {
+	for path := range sess.locks {
+		if path == filePath || strings.HasPrefix(string(path), string(filePath) + "/") {
+			delete(sess.locks, path)
+		}
+	}
+}
+
+// Find the files and directories matching a path prefix, or a glob such as
+// /ls/local/job/lock_*, along with their metadata.
+func (sess *ClientSession) Find(pattern string) ([]api.FindEntry, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return nil, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.FindRequest{ClientID: sess.clientID, Pattern: pattern}
+	resp := &api.FindResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Find", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return resp.Entries, err
+}
+
+// Get the quota usage of a directory and of this session.
+func (sess *ClientSession) GetQuotaUsage(handle api.Handle) (api.QuotaUsage, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return api.QuotaUsage{}, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.GetQuotaUsageRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.GetQuotaUsageResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.GetQuotaUsage", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return resp.Usage, err
+}
+
+// Get the metadata of a file or directory: instance number, generation
+// numbers, creation and modification times, size and checksum.
+func (sess *ClientSession) Stat(handle api.Handle) (api.NodeStat, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return api.NodeStat{}, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.StatRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.StatResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Stat", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return resp.Stat, err
+}
+
+// Apply ops atomically if all the guards hold. Returns false if a guard did
+// not hold, in which case nothing was applied.
+func (sess *ClientSession) Txn(guards []api.TxnGuard, ops []api.TxnOp) (bool, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.TxnRequest{ClientID: sess.clientID, Guards: guards, Ops: ops}
+	resp := &api.TxnResponse{}
+	for _, op := range ops {
+		sess.uncache(op.Filepath)
+	}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.Txn", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
+	return resp.IsSuccessful, err
+}
+
+func (sess *ClientSession) SetMandatory(handle api.Handle, mandatory bool) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.SetMandatoryRequest{ClientID: sess.clientID, Handle: handle, Mandatory: mandatory}
+	resp := &api.SetMandatoryResponse{}
+	sess.uncache(handle.Path)
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.SetMandatory", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return err
+}
+
+func (sess *ClientSession) GetACL(handle api.Handle) (api.ACL, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return api.ACL{}, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.GetACLRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.GetACLResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.GetACL", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return resp.ACL, err
+}
+
+func (sess *ClientSession) SetACL(handle api.Handle, acl api.ACL) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	req := api.SetACLRequest{ClientID: sess.clientID, Handle: handle, ACL: acl}
+	resp := &api.SetACLResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.SetACL", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return err
+}
+
+func (sess *ClientSession) DeleteLock(handle api.Handle) error {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
@@ -318,8 +783,9 @@ func (sess *ClientSession) DeleteLock(filePath api.FilePath) error {
 		}
 	}
 	sess.logger.Printf("Sending DeleteLock request to server %s", sess.serverAddr)
-	req := api.DeleteLockRequest{ClientID: sess.clientID, Filepath: filePath}
+	req := api.DeleteLockRequest{ClientID: sess.clientID, Handle: handle}
 	resp := &api.DeleteLockResponse{}
+	sess.uncache(handle.Path)
 
 	var err error
 	for {  // If we get a connection problem, keep trying.
@@ -331,12 +797,12 @@ func (sess *ClientSession) DeleteLock(filePath api.FilePath) error {
 	if err != nil {
 		sess.logger.Printf("DeleteLock with server %s failed with error %s", sess.serverAddr, err.Error())
 	} else {
-		sess.logger.Printf("Delete Lock successfully at filepath %s in session with %s", filePath, sess.serverAddr)
+		sess.logger.Printf("Delete Lock successfully at filepath %s in session with %s", handle.Path, sess.serverAddr)
 	}
 	return err
 }
 
-func (sess *ClientSession) TryAcquireLock(filePath api.FilePath, mode api.LockMode) (bool, error) {
+func (sess *ClientSession) TryAcquireLock(handle api.Handle, mode api.LockMode) (bool, error) {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
@@ -346,13 +812,14 @@ func (sess *ClientSession) TryAcquireLock(filePath api.FilePath, mode api.LockMo
 			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
 		}
 	}
-	/*_, ok := sess.locks[filePath]
+	// Changing the mode of a held lock goes through UpgradeLock/DowngradeLock.
+	_, ok := sess.locks[handle.Path]
 	if ok {
-		return false, errors.New(fmt.Sprintf("Client already owns the lock %s", filePath))
-	}*/
+		return false, errors.New(fmt.Sprintf("Client already owns the lock %s", handle.Path))
+	}
 
 	//sess.logger.Printf("Sending TryAcquireLock request to server %s", sess.serverAddr)
-	req := api.TryAcquireLockRequest{ClientID: sess.clientID, Filepath: filePath, Mode: mode}
+	req := api.TryAcquireLockRequest{ClientID: sess.clientID, Handle: handle, Mode: mode}
 	resp := &api.TryAcquireLockResponse{}
 
 	var err error
@@ -364,12 +831,80 @@ func (sess *ClientSession) TryAcquireLock(filePath api.FilePath, mode api.LockMo
 	}
 
 	if resp.IsSuccessful {
-		sess.locks[filePath] = mode
+		sess.locks[handle.Path] = mode
+	}
+	return resp.IsSuccessful, err
+}
+
+// Try to acquire all of the requested locks, or none of them. Each request
+// names the lock by a handle opened on it.
+func (sess *ClientSession) TryAcquireLocks(requests []api.LockRequest) (bool, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	for _, request := range requests {
+		_, ok := sess.locks[request.Handle.Path]
+		if ok {
+			return false, errors.New(fmt.Sprintf("Client already owns the lock %s", request.Handle.Path))
+		}
+	}
+
+	req := api.TryAcquireLocksRequest{ClientID: sess.clientID, Locks: requests}
+	resp := &api.TryAcquireLocksResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.TryAcquireLocks", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if resp.IsSuccessful {
+		for _, request := range requests {
+			sess.locks[request.Handle.Path] = request.Mode
+		}
 	}
 	return resp.IsSuccessful, err
 }
 
-func (sess *ClientSession) ReleaseLock(filePath api.FilePath) error {
+// Acquire the lock, blocking on the server until the lock is granted
+// or the timeout expires.
+func (sess *ClientSession) AcquireLock(handle api.Handle, mode api.LockMode, timeout time.Duration) (bool, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+
+	req := api.AcquireLockRequest{ClientID: sess.clientID, Handle: handle, Mode: mode, Timeout: timeout}
+	resp := &api.AcquireLockResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.AcquireLock", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if resp.IsSuccessful {
+		sess.locks[handle.Path] = mode
+	}
+	return resp.IsSuccessful, err
+}
+
+func (sess *ClientSession) ReleaseLock(handle api.Handle) error {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
@@ -379,13 +914,13 @@ func (sess *ClientSession) ReleaseLock(filePath api.FilePath) error {
 			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
 		}
 	}
-	_, ok := sess.locks[filePath]
+	_, ok := sess.locks[handle.Path]
 	if !ok {
-		return errors.New(fmt.Sprintf("Client does not own the lock %s", filePath))
+		return errors.New(fmt.Sprintf("Client does not own the lock %s", handle.Path))
 	}
 
 	//sess.logger.Printf("Sending ReleaseLock request to server %s", sess.serverAddr)
-	req := api.ReleaseLockRequest{ClientID: sess.clientID, Filepath: filePath}
+	req := api.ReleaseLockRequest{ClientID: sess.clientID, Handle: handle}
 	resp := &api.ReleaseLockResponse{}
 
 	var err error
@@ -397,29 +932,212 @@ func (sess *ClientSession) ReleaseLock(filePath api.FilePath) error {
 	}
 
 	if err == nil {
-		delete(sess.locks, filePath)
+		delete(sess.locks, handle.Path)
+	}
+	return err
+}
+
+// Set the policy used to schedule SHARED and EXCLUSIVE requests on a lock.
+func (sess *ClientSession) SetLockPolicy(handle api.Handle, policy api.LockPolicy) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+
+	req := api.SetLockPolicyRequest{ClientID: sess.clientID, Handle: handle, Policy: policy}
+	resp := &api.SetLockPolicyResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.SetLockPolicy", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
 	}
+
 	return err
 }
 
-func (sess *ClientSession) ReadContent(filePath api.FilePath) (string,error) {
+// Upgrade a lock held in SHARED mode to EXCLUSIVE mode, waiting up to the
+// timeout for other holders to release the lock.
+func (sess *ClientSession) UpgradeLock(handle api.Handle, timeout time.Duration) (bool, error) {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
 		case <-sess.jeopardyChan:
 			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
 		case <-time.After(durationJeopardyOver):
-			return "", errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
 		}
 	}
-	_, ok := sess.locks[filePath]
+	mode, ok := sess.locks[handle.Path]
+	if !ok || mode != api.SHARED {
+		return false, errors.New(fmt.Sprintf("Client does not own the lock %s in SHARED mode", handle.Path))
+	}
+
+	req := api.UpgradeLockRequest{ClientID: sess.clientID, Handle: handle, Timeout: timeout}
+	resp := &api.UpgradeLockResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.UpgradeLock", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if resp.IsSuccessful {
+		sess.locks[handle.Path] = api.EXCLUSIVE
+	}
+	return resp.IsSuccessful, err
+}
+
+// Downgrade a lock held in EXCLUSIVE mode to SHARED mode.
+func (sess *ClientSession) DowngradeLock(handle api.Handle) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	mode, ok := sess.locks[handle.Path]
+	if !ok || mode != api.EXCLUSIVE {
+		return errors.New(fmt.Sprintf("Client does not own the lock %s in EXCLUSIVE mode", handle.Path))
+	}
+
+	req := api.DowngradeLockRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.DowngradeLockResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.DowngradeLock", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if err == nil {
+		sess.locks[handle.Path] = api.SHARED
+	}
+	return err
+}
+
+// Set how long the lock stays unavailable to other clients if this client's
+// session ends while holding it.
+func (sess *ClientSession) SetLockDelay(handle api.Handle, lockDelay time.Duration) error {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	_, ok := sess.locks[handle.Path]
 	if !ok {
-		return "", errors.New(fmt.Sprintf("Client does not own the lock %s", filePath))
+		return errors.New(fmt.Sprintf("Client does not own the lock %s", handle.Path))
+	}
+
+	req := api.SetLockDelayRequest{ClientID: sess.clientID, Handle: handle, LockDelay: lockDelay}
+	resp := &api.SetLockDelayResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.SetLockDelay", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
 	}
 
+	return err
+}
+
+// Get a sequencer for a lock held by this client, to be passed on to
+// other servers that need to check the lock is still held.
+func (sess *ClientSession) GetSequencer(handle api.Handle) (api.Sequencer, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return api.Sequencer{}, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	_, ok := sess.locks[handle.Path]
+	if !ok {
+		return api.Sequencer{}, errors.New(fmt.Sprintf("Client does not own the lock %s", handle.Path))
+	}
+
+	req := api.GetSequencerRequest{ClientID: sess.clientID, Handle: handle}
+	resp := &api.GetSequencerResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.GetSequencer", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return resp.Sequencer, err
+}
+
+// Check whether a sequencer received from another client is still valid.
+func (sess *ClientSession) CheckSequencer(sequencer api.Sequencer) (bool, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+
+	req := api.CheckSequencerRequest{ClientID: sess.clientID, Sequencer: sequencer}
+	resp := &api.CheckSequencerResponse{}
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.CheckSequencer", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	return resp.IsValid, err
+}
+
+func (sess *ClientSession) ReadContent(handle api.Handle) ([]byte,error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return nil, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	// Serve the read locally if the master let us cache the content.
+	if content, ok := sess.cachedContent(handle.Path); ok {
+		return content, nil
+	}
+
+	// Locks are advisory: the server checks the lock only for mandatory files.
 	//sess.logger.Printf("Sending ReleaseLock request to server %s", sess.serverAddr)
-	req := api.ReadRequest{ClientID: sess.clientID, Filepath: filePath}
+	req := api.ReadRequest{ClientID: sess.clientID, Handle: handle}
 	resp := &api.ReadResponse{}
+	gen := sess.cacheGeneration()
 
 	var err error
 	for {  // If we get a connection problem, keep trying.
@@ -428,11 +1146,14 @@ func (sess *ClientSession) ReadContent(filePath api.FilePath) (string,error) {
 			break
 		}
 	}
+	if err == nil && resp.Cacheable {
+		sess.cacheContent(handle.Path, resp.Content, gen)
+	}
 
 	return resp.Content, err
 }
 
-func (sess *ClientSession) WriteContent(filePath api.FilePath, content string) (bool,error) {
+func (sess *ClientSession) WriteContent(handle api.Handle, content []byte) (bool,error) {
 	if sess.jeopardyFlag {
 		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
 		select {
@@ -442,14 +1163,15 @@ func (sess *ClientSession) WriteContent(filePath api.FilePath, content string) (
 			return false, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
 		}
 	}
-	_, ok := sess.locks[filePath]
+	_, ok := sess.locks[handle.Path]
 	if !ok {
-		return false, errors.New(fmt.Sprintf("Client does not own the lock %s", filePath))
+		return false, errors.New(fmt.Sprintf("Client does not own the lock %s", handle.Path))
 	}
 
 	//sess.logger.Printf("Sending ReleaseLock request to server %s", sess.serverAddr)
-	req := api.WriteRequest{ClientID: sess.clientID, Filepath: filePath, Content: content}
+	req := api.WriteRequest{ClientID: sess.clientID, Handle: handle, Content: content}
 	resp := &api.WriteResponse{}
+	sess.uncache(handle.Path)
 
 	var err error
 	for {  // If we get a connection problem, keep trying.
@@ -458,10 +1180,56 @@ func (sess *ClientSession) WriteContent(filePath api.FilePath, content string) (
 			break
 		}
 	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
 
 	return resp.IsSuccessful, err
 }
 
+// Write the content only if the file's content generation (see Stat) still
+// equals expectedGeneration. Returns the new content generation on success.
+func (sess *ClientSession) CompareAndSetContent(handle api.Handle, content []byte, expectedGeneration uint64) (bool, uint64, error) {
+	if sess.jeopardyFlag {
+		durationJeopardyOver := time.Until(sess.startTime.Add(sess.leaseLength + JeopardyDuration))
+		select {
+		case <-sess.jeopardyChan:
+			sess.logger.Printf("session with %s reestablished", sess.serverAddr)
+		case <-time.After(durationJeopardyOver):
+			return false, 0, errors.New(fmt.Sprintf("session with %s expired", sess.serverAddr))
+		}
+	}
+	_, ok := sess.locks[handle.Path]
+	if !ok {
+		return false, 0, errors.New(fmt.Sprintf("Client does not own the lock %s", handle.Path))
+	}
+
+	req := api.CompareAndSetRequest{ClientID: sess.clientID, Handle: handle, Content: content, ExpectedGeneration: expectedGeneration}
+	resp := &api.CompareAndSetResponse{}
+	sess.uncache(handle.Path)
+
+	var err error
+	for {  // If we get a connection problem, keep trying.
+		err = sess.rpcClient.Call("Handler.CompareAndSetContent", req, resp)
+		if err != io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if err == nil {
+		// Quota and size errors come back in the response, typed.
+		err = resp.Err()
+	}
+
+	return resp.IsSuccessful, resp.ContentGeneration, err
+}
+
+// Returns the number of events dropped so far because the callbacks fell
+// behind.
+func (sess *ClientSession) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&sess.droppedEvents)
+}
+
 func (sess *ClientSession) IsExpired() bool {
 	return sess.expired
 }
@@ -0,0 +1,145 @@
+// Streaming Watch: a Watcher long-polls the server for changes under a
+// prefix and delivers them on a channel, tagged with their Raft log index.
+// If the session fails over to a new master, the Watcher resumes from the
+// last index it delivered, so no change is missed.
+
+package client
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// How long each Watch call waits on the server for a change.
+const WatchPollTimeout = 10 * time.Second
+
+// Returned by Watcher.Err when the server's history no longer reaches back
+// to the index the watcher had to resume from. The watcher must re-read the
+// state it cares about and start a new watch.
+type CompactedError struct {
+	FromIndex uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("compacted: changes after index %d are no longer available", e.FromIndex)
+}
+
+type Watcher struct {
+	// Changes under the prefix, in log order. Closed when the watcher stops.
+	Events		<-chan api.WatchEvent
+
+	sess		*ClientSession
+	prefix		string
+	events		chan api.WatchEvent
+	stopChan	chan struct{}
+	stopOnce	sync.Once
+
+	mu			sync.Mutex
+	index		uint64  // Log index up to which changes were delivered.
+	err			error   // Why the watcher stopped, if not by Stop.
+}
+
+// Watch changes to nodes whose path starts with prefix, after log index
+// fromIndex. Pass 0 to get every change the server still remembers, or
+// the Index of a previous Watcher to carry on where it stopped.
+func (sess *ClientSession) Watch(prefix string, fromIndex uint64) *Watcher {
+	events := make(chan api.WatchEvent, 100)
+	w := &Watcher{
+		Events:		events,
+		sess:		sess,
+		prefix:		prefix,
+		events:		events,
+		stopChan:	make(chan struct{}),
+		index:		fromIndex,
+	}
+	go w.run()
+	return w
+}
+
+// Stop the watcher. Events is closed soon after.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopChan)
+	})
+}
+
+// Index returns the log index up to which changes were delivered.
+func (w *Watcher) Index() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.index
+}
+
+// Err returns why the watcher stopped, once Events is closed: a
+// *CompactedError, the session expiring, or an error from the server.
+// It returns nil if the watcher was stopped with Stop.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) run() {
+	defer close(w.events)
+
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		default:
+		}
+		if w.sess.expired {
+			w.stop(errors.New(fmt.Sprintf("session with %s expired", w.sess.serverAddr)))
+			return
+		}
+
+		req := api.WatchRequest{
+			ClientID: w.sess.clientID,
+			Prefix: w.prefix,
+			FromIndex: w.Index(),
+			Timeout: WatchPollTimeout,
+		}
+		resp := &api.WatchResponse{}
+		err := w.sess.rpcClient.Call("Handler.Watch", req, resp)
+		if err != nil {
+			// Server errors are final, unless the session is failing over
+			// and the new master does not know it yet. Connection problems
+			// are retried until the session reconnects or expires.
+			if _, isServerError := err.(rpc.ServerError); isServerError && !w.sess.jeopardyFlag {
+				w.stop(err)
+				return
+			}
+			if err != io.ErrUnexpectedEOF {
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if resp.Compacted {
+			w.stop(&CompactedError{FromIndex: req.FromIndex})
+			return
+		}
+
+		for _, e := range resp.Events {
+			select {
+			case w.events <- e:
+			case <-w.stopChan:
+				return
+			}
+		}
+		w.mu.Lock()
+		w.index = resp.NextIndex
+		w.mu.Unlock()
+	}
+}
+
+// Record why the watcher stopped.
+func (w *Watcher) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
@@ -29,31 +29,37 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	errOpenLock := sess.OpenLock("Lock/Lock1")
+	for _, dir := range []api.FilePath{"/ls/local", "/ls/local/Lock"} {
+		err = sess.CreateDirectory(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	lock, errOpenLock := sess.OpenLock("/ls/local/Lock/Lock1")
 	if errOpenLock != nil {
 		log.Fatal(errOpenLock)
 	}
 	startTime := time.Now()
 	for {
-		isSuccessful, err := sess.TryAcquireLock("Lock/Lock1", api.EXCLUSIVE)
+		isSuccessful, err := sess.TryAcquireLock(lock, api.EXCLUSIVE)
 		if err != nil {
 			log.Println(err)
 		}
 		if isSuccessful && err == nil {
-			isSuccessful, err = sess.WriteContent("Lock/Lock1", acquireLock_clientID)
+			isSuccessful, err = sess.WriteContent(lock, []byte(acquireLock_clientID))
 			if !isSuccessful {
 				fmt.Println("Unexpected Error Writing to Lock")
 			}
 			if err != nil {
 				log.Fatal(err)
 			}
-			content, err := sess.ReadContent("Lock/Lock1")
+			content, err := sess.ReadContent(lock)
 		        if err != nil {
                 		log.Fatal(err)
        			} else {
                 		fmt.Printf("Read Content is %s\n",content)
                         }
-        		if content == acquireLock_clientID {
+        		if string(content) == acquireLock_clientID {
                 		elapsed := time.Since(startTime)
                 		log.Printf("Successfully acquired lock after %s\n",elapsed)
         		}
@@ -61,13 +67,13 @@ func main() {
 		}
 	}
 
-	content, err := sess.ReadContent("Lock/Lock1")
+	content, err := sess.ReadContent(lock)
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		fmt.Printf("Read Content is %s\n",content)
 	}
-	if content == acquireLock_clientID {
+	if string(content) == acquireLock_clientID {
 		elapsed := time.Since(startTime)
 		log.Printf("Successfully acquired lock after %s\n",elapsed)
 	}
@@ -40,9 +40,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var lockName api.FilePath = "lock"
+	var lockName api.FilePath = "/ls/local/lock"
 
-	err = sess.OpenLock(lockName)
+	err = sess.CreateDirectory("/ls/local")
+	if err != nil {
+		fmt.Println("Failed to create lock directory. Exiting.")
+	}
+
+	lock, err := sess.OpenLock(lockName)
 	if err != nil {
 		fmt.Println("Failed to open lock. Exiting.")
 	}
@@ -65,7 +70,7 @@ func main() {
 
 		default:
 			//startTime = time.Now()
-			ok, err := sess.TryAcquireLock(lockName, api.SHARED)
+			ok, err := sess.TryAcquireLock(lock, api.SHARED)
 			//timeTrack(startTime, "TryAcquire")
 
 			if err != nil {
@@ -73,9 +78,13 @@ func main() {
 					sess, err = client.InitSession(api.ClientID(client_fast_reqs_id))
 					if err != nil {
 						log.Fatal(err)
-					} else {
-						continue
 					}
+					// Handles do not outlive their session.
+					lock, err = sess.OpenLock(lockName)
+					if err != nil {
+						log.Fatal(err)
+					}
+					continue
 				}
 				log.Printf("TryAcquire failed with error: %s\n", err.Error())
 				// Say we acquire a lock, then we pause that node
@@ -92,7 +101,7 @@ func main() {
 			}
 			counter += 1
 			//startTime = time.Now()
-			err = sess.ReleaseLock(lockName)
+			err = sess.ReleaseLock(lock)
 			//timeTrack(startTime, "Release")
 
 			if err != nil {
@@ -28,25 +28,31 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	errOpenLock := sess.OpenLock("Lock/Lock1")
+	for _, dir := range []api.FilePath{"/ls/local", "/ls/local/Lock"} {
+		err = sess.CreateDirectory(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	lock, errOpenLock := sess.OpenLock("/ls/local/Lock/Lock1")
 	if errOpenLock != nil {
 		log.Fatal(errOpenLock)
 	}
-	isSuccessful, err := sess.TryAcquireLock("Lock/Lock1", api.EXCLUSIVE)
+	isSuccessful, err := sess.TryAcquireLock(lock, api.EXCLUSIVE)
 	if !isSuccessful {
 		fmt.Printf("Lock Acquire Unexpected Failure")
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	isSuccessful, err = sess.WriteContent("Lock/Lock1", leader_election_id1)
+	isSuccessful, err = sess.WriteContent(lock, []byte(leader_election_id1))
 	if !isSuccessful {
 		fmt.Println("Unexpected Error Writing to Lock")
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	content, err := sess.ReadContent("Lock/Lock1")
+	content, err := sess.ReadContent(lock)
 	if err != nil {
 		log.Fatal(err)
 	} else {
@@ -29,6 +29,8 @@ var (
 	nodeId		string		// Node ID.
 	join		string		// Address of existing cluster at which to join.
 	inmem		bool		// If true, keep log and stable storage in memory.
+	maxFileSize	int			// Largest file contents accepted, in bytes.
+	quotas		config.Quotas	// Limits on the size of the namespace.
 )
 
 func init() {
@@ -38,6 +40,10 @@ func init() {
 	flag.StringVar(&nodeId, "id", "", "node id")
 	flag.StringVar(&join, "join", "", "join to existing cluster at this address")
 	flag.BoolVar(&inmem, "inmem", false, "log and stable storage in memory")
+	flag.IntVar(&maxFileSize, "maxfilesize", config.DefaultMaxFileSize, "maximum size of file contents in bytes")
+	flag.IntVar(&quotas.MaxNodesPerDir, "maxnodesperdir", config.DefaultMaxNodesPerDir, "maximum number of children of a directory (0 for no limit)")
+	flag.IntVar(&quotas.MaxSubtreeBytes, "maxsubtreebytes", config.DefaultMaxSubtreeBytes, "maximum bytes of content below a directory (0 for no limit)")
+	flag.IntVar(&quotas.MaxLocksPerSession, "maxlockspersession", config.DefaultMaxLocksPerSession, "maximum number of locks a session may have open (0 for no limit)")
 }
 
 func main() {
@@ -49,7 +55,7 @@ func main() {
 	)
 
 	// Create new Chubby config.
-	c = config.NewConfig(listen, raftDir, raftBind, nodeId, join, inmem)
+	c = config.NewConfig(listen, raftDir, raftBind, nodeId, join, inmem, maxFileSize, quotas)
 	//fmt.Println(c)
 
 	quitCh := make(chan os.Signal, 1)
@@ -17,18 +17,18 @@ func timeTrack(start time.Time, name string) {
 }
 
 func acquire_release(clientID string, sess *client.ClientSession) {
-	var lockNames []string
+	var locks []api.Handle
 	for i := 0; i < 100; i++ {
-		lockName := fmt.Sprintf("lock_%d_%s",i, string(clientID))
-		err := sess.OpenLock(api.FilePath(lockName))
+		lockName := fmt.Sprintf("/ls/local/lock_%d_%s",i, string(clientID))
+		lock, err := sess.OpenLock(api.FilePath(lockName))
 		if err != nil {
 			fmt.Println("Failed to open lock. Exiting.")
 		}
-		lockNames = append(lockNames, lockName)
+		locks = append(locks, lock)
 	}
 	for i := 0; i < 1000000; i++ {
 		for j := 0; j < 100; j++ {
-			ok, err := sess.TryAcquireLock(api.FilePath(lockNames[j]), api.EXCLUSIVE)
+			ok, err := sess.TryAcquireLock(locks[j], api.EXCLUSIVE)
 			if !ok {
 				log.Println("Failed to acquire lock. Continuing.")
 			} else {
@@ -37,7 +37,7 @@ func acquire_release(clientID string, sess *client.ClientSession) {
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = sess.ReleaseLock(api.FilePath(lockNames[j]))
+			err = sess.ReleaseLock(locks[j])
 
 			if err != nil {
 				log.Printf("Release failed with error: %s\n", err.Error())
@@ -65,18 +65,22 @@ func main () {
 		}
 		sessions = append(sessions, sess)
 	}
+	err := sessions[199].CreateDirectory("/ls/local")
+	if err != nil {
+		log.Fatal(err)
+	}
 	for i :=0; i < 199; i++ {
 		go acquire_release(clientIDs[i], sessions[i])
 	}
 
-	var lockNames []string
+	var locks []api.Handle
 	for i := 0; i < 100; i++ {
-		lockName := fmt.Sprintf("lock_%d_%s",i, string(clientIDs[99]))
-		err := sessions[199].OpenLock(api.FilePath(lockName))
+		lockName := fmt.Sprintf("/ls/local/lock_%d_%s",i, string(clientIDs[99]))
+		lock, err := sessions[199].OpenLock(api.FilePath(lockName))
 		if err != nil {
 			fmt.Println("Failed to open lock. Exiting.")
 		}
-		lockNames = append(lockNames, lockName)
+		locks = append(locks, lock)
 	}
 
 	counter := 0
@@ -89,14 +93,14 @@ func main () {
 
 	for i := 0; i < 1000000; i++ {
 		for j := 0; j < 100; j++ {
-			ok, err := sessions[199].TryAcquireLock(api.FilePath(lockNames[j]), api.EXCLUSIVE)
+			ok, err := sessions[199].TryAcquireLock(locks[j], api.EXCLUSIVE)
 			if !ok {
 				log.Println("Failed to acquire lock. Continuing.")
 			}
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = sessions[199].ReleaseLock(api.FilePath(lockNames[j]))
+			err = sessions[199].ReleaseLock(locks[j])
 
 			if err != nil {
 				log.Printf("Release failed with error: %s\n", err.Error())
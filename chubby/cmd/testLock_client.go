@@ -29,9 +29,17 @@ func main() {
 	sess1, err := client.InitSession(api.ClientID(clientID1))
 	sess2, err := client.InitSession(api.ClientID(clientID2))
 
+	// Create the lock directory
+	for _, dir := range []api.FilePath{"/ls/local", "/ls/local/LOCK"} {
+		err = sess1.CreateDirectory(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Test Open Locks
-	errOpenLock1 := sess1.OpenLock("LOCK/Lock1")
-	errOpenLock2 := sess2.OpenLock("LOCK/Lock2")
+	lock1, errOpenLock1 := sess1.OpenLock("/ls/local/LOCK/Lock1")
+	_, errOpenLock2 := sess2.OpenLock("/ls/local/LOCK/Lock2")
 
 	if errOpenLock1 != nil {
 		log.Printf("Session 1 has trouble opening lock ")
@@ -46,7 +54,7 @@ func main() {
 		log.Printf("Session 2 has opened lock successfully")
 	}
 
-	errOpenLock1 = sess1.OpenLock("LOCK/LockShared")
+	sharedLock1, errOpenLock1 := sess1.OpenLock("/ls/local/LOCK/LockShared")
 	if errOpenLock1 != nil {
 		log.Printf("Session 1 has trouble opening lock")
 		log.Fatal(errOpenLock1)
@@ -54,8 +62,24 @@ func main() {
 		log.Printf("Session 1 has opened lock successfully")
 	}
 
+	// Handles belong to the session that opened them.
+	sharedLock2, errOpenLock2 := sess2.OpenLock("/ls/local/LOCK/LockShared")
+	if errOpenLock2 != nil {
+		log.Printf("Session 2 has trouble opening lock")
+		log.Fatal(errOpenLock2)
+	}
+	lock1Sess2, errOpenLock2 := sess2.OpenLock("/ls/local/LOCK/Lock1")
+	if errOpenLock2 != nil {
+		log.Printf("Session 2 has trouble opening lock")
+		log.Fatal(errOpenLock2)
+	}
+	isSuccessful, acquireErr := sess2.TryAcquireLock(lock1, api.EXCLUSIVE)
+	if isSuccessful || acquireErr == nil {
+		log.Printf("Should fail because session 2 is using a handle of session 1")
+	}
+
 	// Test TryAcquire Lock
-	isSuccessful, acquireErr := sess1.TryAcquireLock("LOCK/Lock1", api.EXCLUSIVE)
+	isSuccessful, acquireErr = sess1.TryAcquireLock(lock1, api.EXCLUSIVE)
 	if !isSuccessful {
 		log.Printf("Try Acquire Lock failed when it should succeed")
 	}
@@ -65,7 +89,7 @@ func main() {
 	}
 
 	// Try Acquire a Shared Lock
-	isSuccessful, acquireErr = sess1.TryAcquireLock("LOCK/LockShared", api.SHARED)
+	isSuccessful, acquireErr = sess1.TryAcquireLock(sharedLock1, api.SHARED)
 	if !isSuccessful {
 		log.Printf("Try Acquire Shared Lock failed when it should succeed")
 	}
@@ -74,7 +98,7 @@ func main() {
 		log.Fatal(acquireErr)
 	}
 
-	isSuccessful, acquireErr = sess2.TryAcquireLock("LOCK/LockShared", api.SHARED)
+	isSuccessful, acquireErr = sess2.TryAcquireLock(sharedLock2, api.SHARED)
 	if !isSuccessful {
 		log.Printf("Try Acquire Shared Lock failed when it should succeed")
 	}
@@ -84,7 +108,7 @@ func main() {
 	}
 
 	// Should not be able to acquire a lock you already acquired
-	isSuccessful, acquireErr = sess1.TryAcquireLock("LOCK/Lock1", api.EXCLUSIVE)
+	isSuccessful, acquireErr = sess1.TryAcquireLock(lock1, api.EXCLUSIVE)
 	if isSuccessful {
 		log.Printf("Should fail because the lock we are trying to acquire is in exclusive mode")
 	}
@@ -93,37 +117,37 @@ func main() {
 	}
 
 	// Should not be able to acquire a lock someone else acquired in exclusive mode
-	isSuccessful, acquireErr = sess2.TryAcquireLock("LOCK/Lock1", api.EXCLUSIVE)
+	isSuccessful, acquireErr = sess2.TryAcquireLock(lock1Sess2, api.EXCLUSIVE)
 	if isSuccessful {
 		log.Printf("Session 2 Should fail but successfuly because the lock we are trying to acquire is in exclusive mode")
 	}
 
 	// Should not be able to release a lock you don't own
-	releaseErr := sess2.ReleaseLock("LOCK/Lock1")
+	releaseErr := sess2.ReleaseLock(lock1Sess2)
 	if releaseErr == nil {
 		log.Printf("Should fail because the lock we are trying to release is a lock we don't own")
 	}
 
 	// Should not be able to delete a lock you don't own
-	deleteErr := sess2.DeleteLock("LOCK/Lock1")
+	deleteErr := sess2.DeleteLock(lock1Sess2)
 	if deleteErr == nil {
 		log.Printf("Delete Lock Should Fail because %s is trying to delete a lock it doesn't own", clientID2)
 	}
 
 	// Test release lock
-	releaseErr = sess1.ReleaseLock("LOCK/Lock1")
+	releaseErr = sess1.ReleaseLock(lock1)
 	if releaseErr != nil {
 		log.Printf("Unexpected Lock release failure")
 		log.Fatal(releaseErr)
 	}
 
 	// Test Delete Lock
-	deleteErr = sess1.DeleteLock("LOCK/Lock1")
+	deleteErr = sess1.DeleteLock(lock1)
 	if deleteErr == nil {
 		log.Printf("Delete Lock Should Fail because %s is trying to delete a lock it doesn't hold", clientID1)
 	}
 
-	isSuccessful, acquireErr = sess1.TryAcquireLock("LOCK/Lock1", api.SHARED)
+	isSuccessful, acquireErr = sess1.TryAcquireLock(lock1, api.SHARED)
 
 	if !isSuccessful {
 		log.Printf("Unexpected Failure to Acquire Lock in Shared Mode")
@@ -132,33 +156,33 @@ func main() {
 		log.Fatal(acquireErr)
 	}
 	// Test Delete Lock
-	deleteErr = sess1.DeleteLock("LOCK/Lock1")
+	deleteErr = sess1.DeleteLock(lock1)
 	if deleteErr == nil {
 		log.Printf("Delete Lock Should Fail because %s is trying to delete a lock it holds in Shared mode", clientID1)
 	}
 
 
 	// Test release lock
-	releaseErr = sess1.ReleaseLock("LOCK/Lock1")
+	releaseErr = sess1.ReleaseLock(lock1)
 	if releaseErr != nil {
 		log.Printf("Unexpected Lock release failure")
 		log.Fatal(releaseErr)
 	}
-	isSuccessful, acquireErr = sess1.TryAcquireLock("LOCK/Lock1", api.EXCLUSIVE)
+	isSuccessful, acquireErr = sess1.TryAcquireLock(lock1, api.EXCLUSIVE)
 	if !isSuccessful {
-		log.Printf("Unexpected Exclusive Acquire Failure at lock path %s", "LOCK/Lock1")
+		log.Printf("Unexpected Exclusive Acquire Failure at lock path %s", "/ls/local/LOCK/Lock1")
 	}
 	if acquireErr != nil {
 		log.Fatal(acquireErr)
 	}
-	deleteErr = sess1.DeleteLock("LOCK/Lock1")
+	deleteErr = sess1.DeleteLock(lock1)
 	if deleteErr != nil {
 		log.Printf("Unexpected Delete err %s", clientID1)
 		log.Fatal(deleteErr)
 	}
 
 	// Test release lock
-	releaseErr = sess1.ReleaseLock("LOCK/Lock1")
+	releaseErr = sess1.ReleaseLock(lock1)
 	if releaseErr == nil {
 		log.Printf("Should fail because trying to release a lock that doesn't exist")
 	}
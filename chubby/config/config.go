@@ -5,6 +5,23 @@
 
 package config
 
+// Default limit on the size of a file's contents, in bytes.
+const DefaultMaxFileSize = 256 * 1024
+
+// Default quotas. Zero means no limit.
+const (
+	DefaultMaxNodesPerDir = 10000
+	DefaultMaxSubtreeBytes = 64 * 1024 * 1024
+	DefaultMaxLocksPerSession = 1000
+)
+
+// Limits that keep one client from growing the store without bound.
+type Quotas struct {
+	MaxNodesPerDir		int  // Most children a directory may have.
+	MaxSubtreeBytes		int  // Most bytes of content below a directory.
+	MaxLocksPerSession	int  // Most locks a session may have open.
+}
+
 type Config struct {
 	Listen   string
 	RaftDir  string
@@ -12,9 +29,11 @@ type Config struct {
 	Join     string
 	NodeID   string
 	InMem	 bool
+	MaxFileSize int  // Largest file contents accepted, in bytes.
+	Quotas   Quotas
 }
 
-func NewConfig(listen, raftDir, raftBind, nodeId, join string, inmem bool) *Config {
+func NewConfig(listen, raftDir, raftBind, nodeId, join string, inmem bool, maxFileSize int, quotas Quotas) *Config {
 	return &Config{
 		Listen:   listen,
 		RaftDir:  raftDir,
@@ -22,5 +41,7 @@ func NewConfig(listen, raftDir, raftBind, nodeId, join string, inmem bool) *Conf
 		NodeID:   nodeId,
 		Join:     join,
 		InMem:    inmem,
+		MaxFileSize: maxFileSize,
+		Quotas:   quotas,
 	}
 }
\ No newline at end of file
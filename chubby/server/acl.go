@@ -0,0 +1,66 @@
+// Permission checks made by the RPC handlers before acting on a request.
+//
+// The ACLs themselves live in the store; see store/acl.go.
+
+package server
+
+import (
+	"cos518project/chubby/api"
+	"path"
+)
+
+// Returns an error unless the client has perm on the file or directory.
+func checkPermission(clientID api.ClientID, filePath api.FilePath, perm api.Permission) error {
+	return app.store.CheckPermission(string(filePath), clientID, perm)
+}
+
+// Creating a node needs WRITE permission on its parent directory.
+func checkCreatePermission(clientID api.ClientID, filePath api.FilePath) error {
+	return checkPermission(clientID, api.FilePath(path.Dir(string(filePath))), api.WRITE)
+}
+
+// Opening a handle needs the permission for each access requested. A node
+// that does not exist yet is created with the ACLs of its parent directory,
+// so those are checked instead, along with the permission to create it.
+func checkOpenPermission(clientID api.ClientID, filePath api.FilePath, mode api.OpenMode) error {
+	target := filePath
+	if !app.store.Exists(string(filePath)) {
+		if err := checkCreatePermission(clientID, filePath); err != nil {
+			return err
+		}
+		target = api.FilePath(path.Dir(string(filePath)))
+	}
+	if mode & api.OPEN_READ != 0 {
+		if err := checkPermission(clientID, target, api.READ); err != nil {
+			return err
+		}
+	}
+	if mode & api.OPEN_WRITE != 0 {
+		if err := checkPermission(clientID, target, api.WRITE); err != nil {
+			return err
+		}
+	}
+	if mode & api.OPEN_CHANGE_ACL != 0 {
+		if err := checkPermission(clientID, target, api.CHANGE_ACL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns whether the client may see a change to the node: it needs READ
+// permission on the node, or on its directory if the node is gone.
+func canSee(clientID api.ClientID, filePath api.FilePath) bool {
+	if app.store.Exists(string(filePath)) {
+		return checkPermission(clientID, filePath, api.READ) == nil
+	}
+	return checkPermission(clientID, api.FilePath(path.Dir(string(filePath))), api.READ) == nil
+}
+
+// The access a handle needs to hold its lock in the given mode.
+func lockOpenMode(mode api.LockMode) api.OpenMode {
+	if mode == api.EXCLUSIVE {
+		return api.OPEN_WRITE
+	}
+	return api.OPEN_READ
+}
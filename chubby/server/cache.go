@@ -0,0 +1,194 @@
+// Consistent client caches, as in Chubby.
+//
+// The leader remembers which sessions cache the content of which files.
+// Before a write commits, it sends invalidations to those sessions with their
+// next KeepAlive response and waits until each has acknowledged, in its next
+// KeepAlive request, or its lease has run out. While any invalidation is in
+// flight, reads are not cacheable, so that no session can cache content that
+// is about to change.
+//
+// The cachers are not replicated. After a failover, a restored session counts
+// as a cacher of every file until it completes its handshake (the client
+// flushes its cache when it goes into jeopardy) or its old lease runs out.
+
+package server
+
+import (
+	"cos518project/chubby/api"
+	"strings"
+	"time"
+)
+
+// Register the session as caching the content of the file, unless an
+// invalidation is in flight. Returns whether the client may cache it.
+// Must be called before the content is read.
+func (sess *Session) cacheNode(path api.FilePath) bool {
+	app.cacheMu.Lock()
+	defer app.cacheMu.Unlock()
+
+	if app.invalidating > 0 {
+		return false
+	}
+	holders, exists := app.cachers[path]
+	if !exists {
+		holders = make(map[*Session]bool)
+		app.cachers[path] = holders
+	}
+	holders[sess] = true
+	return true
+}
+
+// Invalidate cached copies of the given file held by sessions other than
+// writer, and wait until they are gone. Call the returned function once the
+// write has committed or failed.
+func invalidateFile(writer *Session, path api.FilePath) func() {
+	return invalidateCaches(writer, func(p api.FilePath) bool {
+		return p == path
+	})
+}
+
+// Invalidate cached copies of files at or below the given path.
+func invalidateSubtree(writer *Session, path api.FilePath) func() {
+	return invalidateCaches(writer, func(p api.FilePath) bool {
+		return p == path || strings.HasPrefix(string(p), string(path) + "/")
+	})
+}
+
+// Invalidate cached copies of the files matching match, held by sessions
+// other than writer, and wait for every session to acknowledge or for its
+// lease to run out. The writer drops its own copy itself.
+func invalidateCaches(writer *Session, match func(api.FilePath) bool) func() {
+	app.cacheMu.Lock()
+	app.invalidating++
+	waits := sendInvalidations(writer, match)
+	app.cacheMu.Unlock()
+
+	for sess, acks := range waits {
+		for _, ack := range acks {
+			sess.waitForAck(ack)
+		}
+	}
+	for _, sess := range allSessions() {
+		if sess != writer {
+			sess.waitForRecovery()
+		}
+	}
+
+	return func() {
+		app.cacheMu.Lock()
+		defer app.cacheMu.Unlock()
+		app.invalidating--
+	}
+}
+
+// Send invalidations without waiting for them, for files deleted as a side
+// effect, e.g. ephemeral files of an ended session.
+func dropCaches(path api.FilePath) {
+	app.cacheMu.Lock()
+	defer app.cacheMu.Unlock()
+
+	sendInvalidations(nil, func(p api.FilePath) bool {
+		return p == path
+	})
+}
+
+// Queue invalidations for the files matching match on the sessions caching
+// them, and forget those sessions as cachers. Returns the acknowledgments to
+// wait for. Caller must hold app.cacheMu.
+func sendInvalidations(writer *Session, match func(api.FilePath) bool) map[*Session][]chan struct{} {
+	waits := make(map[*Session][]chan struct{})
+	for path, holders := range app.cachers {
+		if !match(path) {
+			continue
+		}
+		for sess := range holders {
+			if sess != writer {
+				waits[sess] = append(waits[sess], sess.queueInvalidation(path))
+			}
+		}
+		delete(app.cachers, path)
+	}
+	return waits
+}
+
+// Forget the session as a cacher of every file, e.g. when it ends.
+func (sess *Session) dropCacher() {
+	app.cacheMu.Lock()
+	defer app.cacheMu.Unlock()
+
+	for path, holders := range app.cachers {
+		delete(holders, sess)
+		if len(holders) == 0 {
+			delete(app.cachers, path)
+		}
+	}
+}
+
+// Queue an invalidation for the next KeepAlive response and wake up the
+// pending KeepAlive. Returns a channel closed once the client acknowledges.
+func (sess *Session) queueInvalidation(path api.FilePath) chan struct{} {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	ack := make(chan struct{})
+	sess.invalidations = append(sess.invalidations, path)
+	sess.unacked[path] = append(sess.unacked[path], ack)
+
+	select {
+	case sess.eventChan <- struct{}{}:
+	default:
+	}
+	return ack
+}
+
+// Remove and return the invalidations queued for the client.
+func (sess *Session) takeInvalidations() []api.FilePath {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	invalidations := sess.invalidations
+	sess.invalidations = nil
+	return invalidations
+}
+
+// Record that the client dropped its cached copies of the given files.
+func (sess *Session) ackInvalidations(paths []api.FilePath) {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	for _, path := range paths {
+		for _, ack := range sess.unacked[path] {
+			close(ack)
+		}
+		delete(sess.unacked, path)
+	}
+}
+
+// Wait until a restored session can no longer be reading from a cache filled
+// under the old master: it completed its handshake, ended, or its old lease
+// ran out.
+func (sess *Session) waitForRecovery() {
+	select {
+	case <-sess.recoveredChan:
+		return
+	default:
+	}
+
+	select {
+	case <-sess.recoveredChan:
+	case <-sess.terminatedChan:
+	case <-time.After(time.Until(sess.cacheExpiry)):
+	}
+}
+
+// Wait until the client acknowledges an invalidation, or until it can no
+// longer be using its cache because its session ended or its lease ran out.
+func (sess *Session) waitForAck(ack chan struct{}) {
+	leaseOver := time.Until(sess.startTime.Add(sess.leaseLength))
+	select {
+	case <-ack:
+	case <-sess.terminatedChan:
+	case <-time.After(leaseOver):
+		app.logger.Printf("Client %s did not acknowledge invalidation before its lease ran out", sess.clientID)
+	}
+}
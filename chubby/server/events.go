@@ -0,0 +1,112 @@
+// Chubby events: clients subscribe to events on a node, and the server
+// queues matching events on the session and returns them with the next
+// KeepAlive response.
+
+package server
+
+import (
+	"cos518project/chubby/api"
+	"cos518project/chubby/store"
+	"time"
+)
+
+// Most events queued on a session between two KeepAlives. Older events are
+// dropped first.
+const MaxQueuedEvents = 1000
+
+// Longest a Watch call may wait for a change.
+const MaxWatchTimeout = 30 * time.Second
+
+// Subscribe the session to events on a node, replacing any earlier
+// subscription. An empty set of events unsubscribes.
+func (sess *Session) Subscribe(path api.FilePath, events api.EventType) {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	if events == 0 {
+		delete(sess.subscriptions, path)
+		return
+	}
+	sess.subscriptions[path] = events
+}
+
+// Restore the subscriptions a client had with the previous master, and tell
+// it about the failover if it asked to be told.
+func (sess *Session) RecoverSubscriptions(subscriptions map[api.FilePath]api.EventType) {
+	for path, events := range subscriptions {
+		sess.Subscribe(path, events)
+	}
+	sess.queueEvent(api.Event{Type: api.MASTER_FAILOVER})
+}
+
+// Queue an event on every session subscribed to it. Called by the store for
+// every change it applies.
+func queueEvent(event api.Event) {
+	for _, sess := range allSessions() {
+		sess.queueEvent(event)
+	}
+}
+
+// Queue an event on the session if it is subscribed to it, and wake up its
+// pending KeepAlive.
+func (sess *Session) queueEvent(event api.Event) {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	if sess.terminated || !sess.isSubscribed(event) {
+		return
+	}
+	if len(sess.events) >= MaxQueuedEvents {
+		sess.events = sess.events[1:]
+	}
+	sess.events = append(sess.events, event)
+
+	select {
+	case sess.eventChan <- struct{}{}:
+	default:
+	}
+}
+
+// Master-failover events concern the whole cell, so any subscription that
+// asks for them matches. Caller must hold sess.eventMu.
+func (sess *Session) isSubscribed(event api.Event) bool {
+	if event.Type == api.MASTER_FAILOVER {
+		for _, events := range sess.subscriptions {
+			if events & api.MASTER_FAILOVER != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return sess.subscriptions[event.Filepath] & event.Type != 0
+}
+
+// Wait for changes after fromIndex to nodes under prefix. Returns
+// compacted if the server's history no longer reaches back to fromIndex.
+func (sess *Session) Watch(prefix string, fromIndex uint64, timeout time.Duration) (events []api.WatchEvent, nextIndex uint64, compacted bool, err error) {
+	if timeout <= 0 || timeout > MaxWatchTimeout {
+		timeout = MaxWatchTimeout
+	}
+	events, nextIndex, err = app.store.Watch(prefix, fromIndex, timeout)
+	if _, ok := err.(*store.CompactedError); ok {
+		app.logger.Printf("Watch of client %s on %s: %s", sess.clientID, prefix, err.Error())
+		return nil, 0, true, nil
+	}
+	return events, nextIndex, false, err
+}
+
+// Remove and return the events queued on the session.
+func (sess *Session) takeEvents() []api.Event {
+	sess.eventMu.Lock()
+	defer sess.eventMu.Unlock()
+
+	events := sess.events
+	sess.events = nil
+
+	// Any wake-up still pending is for events we are returning now.
+	select {
+	case <-sess.eventChan:
+	default:
+	}
+	return events
+}
@@ -0,0 +1,133 @@
+// Master fail-over, as in Chubby.
+//
+// Session records are replicated through the store. A new master restores
+// every session from them, extending each lease conservatively: the client
+// may hold a lease up to the last expiry the old master recorded, and gets
+// a grace period on top to find the new master. Until a client re-handshakes
+// with a KeepAlive, any other request of its session is rejected.
+
+package server
+
+import (
+	"cos518project/chubby/api"
+	"cos518project/chubby/store"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How long a new master waits for the log to be applied before restoring
+// sessions.
+const BarrierTimeout = 10 * time.Second
+
+// Look up the session of a client for a request other than a KeepAlive.
+func lookupSession(clientID api.ClientID) (*Session, error) {
+	sess, ok := getSession(clientID)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No session exists for %s", clientID))
+	}
+	if sess.recovering {
+		return nil, errors.New(fmt.Sprintf("Session of %s must send a KeepAlive to the new master first", clientID))
+	}
+	return sess, nil
+}
+
+// Record the session in the replicated store: its lease expiry and open
+// handles.
+func (sess *Session) persist() {
+	app.lockMu.Lock()
+	record := &store.SessionRecord{
+		ClientID: sess.clientID,
+		LeaseExpiry: sess.startTime.Add(sess.leaseLength),
+	}
+	for _, h := range sess.handles {
+		record.Handles = append(record.Handles, h.Handle)
+	}
+	terminated := sess.terminated
+	app.lockMu.Unlock()
+
+	if terminated {
+		return
+	}
+	if err := app.store.SetSession(record); err != nil {
+		app.logger.Printf("error when recording session of client %s: %s", sess.clientID, err.Error())
+	}
+}
+
+// Restore the sessions recorded by the previous master. Called on becoming
+// leader, before clients can reach this node as leader.
+func restoreSessions() {
+	// Make sure every session record the old master wrote is applied.
+	if err := app.store.Raft.Barrier(BarrierTimeout).Error(); err != nil {
+		app.logger.Printf("error when waiting for the log before restoring sessions: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for clientID, record := range app.store.Sessions() {
+		sess := newSession(clientID)
+		sess.recovering = true
+		sess.recoveredChan = make(chan struct{})
+		sess.cacheExpiry = record.LeaseExpiry
+		sess.leaseLength = FailoverGracePeriod
+		if record.LeaseExpiry.After(now) {
+			sess.leaseLength += record.LeaseExpiry.Sub(now)
+		}
+
+		app.lockMu.Lock()
+		for _, h := range record.Handles {
+			sess.handles[h.ID] = &handle{Handle: h}
+			if h.ID > sess.lastHandle {
+				sess.lastHandle = h.ID
+			}
+			if app.store.Exists(string(h.Path)) && !app.store.IsDir(string(h.Path)) {
+				sess.opened[h.Path] = true
+			}
+		}
+		app.lockMu.Unlock()
+
+		// The client may already have found us.
+		if !addSession(sess) {
+			continue
+		}
+		sess.RecoverLocks(nil)
+		go sess.MonitorSession()
+		app.logger.Printf("Restored session of client %s: lease %s", clientID, sess.leaseLength.String())
+	}
+}
+
+// Drop the in-memory sessions on losing leadership, without releasing
+// anything: the next master restores them from the session records.
+func abandonSessions() {
+	app.sessionMu.Lock()
+	sessions := app.sessions
+	app.sessions = make(map[api.ClientID]*Session)
+	app.sessionMu.Unlock()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+	for _, sess := range sessions {
+		if !sess.terminated {
+			sess.terminated = true
+			close(sess.terminatedChan)
+		}
+	}
+}
+
+// Complete the fail-over handshake of a restored session. The client
+// restarts its lease clock on hearing from us, so we restart ours too.
+// Returns the rest of the lease.
+func (sess *Session) handshake() time.Duration {
+	remaining := time.Until(sess.startTime.Add(sess.leaseLength))
+	if remaining < 0 {
+		remaining = 0
+	}
+	sess.startTime = time.Now()
+	sess.leaseLength = remaining
+	sess.recovering = false
+	close(sess.recoveredChan)
+	sess.persist()
+
+	app.logger.Printf("Client %s re-established its session after failover", sess.clientID)
+	return remaining
+}
@@ -46,8 +46,21 @@ func (h *Handler) InitSession(req api.InitSessionRequest, res *api.InitSessionRe
 		return errors.New(fmt.Sprintf("Node %s is not the leader", app.address))
 	}
 
-	_, err := CreateSession(api.ClientID(req.ClientID))
-	return err
+	// A client starting over while the session it had with the previous
+	// master is being restored does not need the old session any more.
+	if old, ok := getSession(req.ClientID); ok && old.recovering {
+		old.TerminateSession()
+		removeSession(req.ClientID)
+	}
+
+	sess, err := CreateSession(api.ClientID(req.ClientID))
+	if err != nil {
+		return err
+	}
+
+	// Locks held by an earlier session of this client are no longer in use.
+	sess.ReleaseStaleLocks()
+	return nil
 }
 
 // KeepAlive calls allow the client to extend the Chubby session.
@@ -58,7 +71,7 @@ func (h *Handler) KeepAlive(req api.KeepAliveRequest, res *api.KeepAliveResponse
 	}
 
 	var err error
-	sess, ok := app.sessions[req.ClientID]
+	sess, ok := getSession(req.ClientID)
 	if !ok {
 		// Probably a jeopardy KeepAlive: create a new session for the client
 		app.logger.Printf("Client %s sent jeopardy KeepAlive: creating new session", req.ClientID)
@@ -67,58 +80,267 @@ func (h *Handler) KeepAlive(req api.KeepAliveRequest, res *api.KeepAliveResponse
 		// Should be ok to not call KeepAlive until later because lease TTL is pretty long (12s)
 		sess, err = CreateSession(req.ClientID)
 		if err != nil {
-			// This shouldn't happen because session shouldn't be in app.sessions struct yet
+			// Only if the client raced with itself, e.g. two KeepAlives at once
 			return err
 		}
 
 		app.logger.Printf("New session for client %s created", req.ClientID)
 
-		// For each lock in the KeepAlive, try to acquire the lock
-		// If any of the acquires fail, terminate the session.
-		for filePath, lockMode := range(req.Locks) {
-			ok, err := sess.TryAcquireLock(filePath, lockMode)
-			if err != nil {
-				// Don't return an error because the session won't terminate!
-				app.logger.Printf("Error when client %s acquiring lock at %s: %s", req.ClientID, filePath, err.Error())
-			}
-			if !ok {
-				app.logger.Printf("Jeopardy client %s failed to acquire lock at %s", req.ClientID, filePath)
-				// This should cause the KeepAlive response to return that session should end.
-				sess.TerminateSession()
+		// Rebuild the session's locks from the replicated lock table.
+		// If the client thinks it holds a lock that the table disagrees
+		// with, terminate the session.
+		if !sess.RecoverLocks(req.Locks) {
+			app.logger.Printf("Jeopardy client %s failed to recover its locks", req.ClientID)
+			// This should cause the KeepAlive response to return that session should end.
+			sess.TerminateSession()
 
-				return nil // Don't return an error because the session won't terminate!
-			}
-			app.logger.Printf("Lock %s reacquired successfully.", filePath)
+			return nil // Don't return an error because the session won't terminate!
 		}
 
+		// Restore the client's handles and subscriptions, which the new
+		// master did not know.
+		sess.RecoverHandles(req.Handles)
+		sess.RecoverSubscriptions(req.Subscriptions)
+
 		app.logger.Printf("Finished jeopardy KeepAlive process for client %s", req.ClientID)
+	} else if sess.recovering {
+		// First KeepAlive since this node took over: check the client's
+		// view of its locks against the lock table, as above, and answer
+		// at once so that the client stops blocking its calls.
+		app.logger.Printf("Client %s sent its first KeepAlive after failover", req.ClientID)
+		if !sess.RecoverLocks(req.Locks) {
+			app.logger.Printf("Jeopardy client %s failed to recover its locks", req.ClientID)
+			sess.TerminateSession()
+			return nil
+		}
+		sess.RecoverHandles(req.Handles)
+		sess.RecoverSubscriptions(req.Subscriptions)
+		sess.ackInvalidations(req.InvalidationAcks)
+
+		res.LeaseLength = sess.handshake()
+		res.Events = sess.takeEvents()
+		return nil
 	}
 
+	// The client dropped these files from its cache.
+	sess.ackInvalidations(req.InvalidationAcks)
+
 	duration := sess.KeepAlive(req.ClientID)
 	res.LeaseLength = duration
+	res.Events = sess.takeEvents()
+	res.Invalidations = sess.takeInvalidations()
 	return nil
 }
 
-// Open a lock.
-func (h *Handler) OpenLock(req api.OpenLockRequest, res *api.OpenLockResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+// Open a handle on a file or directory, creating the file if asked to.
+// ACLs are checked here, once: the handle records the access granted.
+func (h *Handler) Open(req api.OpenRequest, res *api.OpenResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	if err := checkOpenPermission(req.ClientID, req.Filepath, req.Mode); err != nil {
+		return err
+	}
+	handle, err := sess.Open(req.Filepath, req.Mode, req.Flags, req.Capacity)
+	if err != nil {
+		return limitError(err, &res.LimitError)
+	}
+	res.Handle = handle
+	return nil
+}
+
+// Close a handle.
+func (h *Handler) Close(req api.CloseRequest, res *api.CloseResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	return sess.Close(req.Handle)
+}
+
+// Create a directory.
+func (h *Handler) CreateDirectory(req api.CreateDirectoryRequest, res *api.CreateDirectoryResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	if err := checkCreatePermission(req.ClientID, req.Filepath); err != nil {
+		return err
+	}
+	err = sess.CreateDirectory(req.Filepath)
+	return limitError(err, &res.LimitError)
+}
+
+// Delete an empty directory.
+func (h *Handler) DeleteDirectory(req api.DeleteDirectoryRequest, res *api.DeleteDirectoryResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	return sess.DeleteDirectory(path)
+}
+
+// Delete a file, or a directory and everything below it.
+func (h *Handler) DeleteRecursive(req api.DeleteRecursiveRequest, res *api.DeleteRecursiveResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	return sess.DeleteRecursive(path, req.Force)
+}
+
+// Move a file, or a directory and everything below it.
+func (h *Handler) Rename(req api.RenameRequest, res *api.RenameResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	if err := checkCreatePermission(req.ClientID, req.NewFilepath); err != nil {
+		return err
+	}
+	err = sess.Rename(path, req.NewFilepath, req.Force)
+	return limitError(err, &res.LimitError)
+}
+
+// List the children of a directory.
+func (h *Handler) ListDirectory(req api.ListDirectoryRequest, res *api.ListDirectoryResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	entries, err := sess.ListDirectory(path)
+	if err != nil {
+		return err
+	}
+	res.Entries = entries
+	return nil
+}
+
+// Find the files and directories matching a path prefix or glob. Matches
+// the client may not read are left out.
+func (h *Handler) Find(req api.FindRequest, res *api.FindResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	entries, err := sess.Find(req.Pattern)
+	if err != nil {
+		return err
+	}
+	res.Entries = []api.FindEntry{}
+	for _, entry := range entries {
+		if checkPermission(req.ClientID, entry.Path, api.READ) == nil {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+	return nil
+}
+
+// Get the quota usage of a directory and of the session.
+func (h *Handler) GetQuotaUsage(req api.GetQuotaUsageRequest, res *api.GetQuotaUsageResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	usage, err := sess.GetQuotaUsage(path)
+	if err != nil {
+		return err
+	}
+	res.Usage = usage
+	return nil
+}
+
+// Subscribe to events on a file or directory.
+func (h *Handler) Subscribe(req api.SubscribeRequest, res *api.SubscribeResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	sess.Subscribe(path, req.Events)
+	sess.setHandleEvents(req.Handle, req.Events)
+	return nil
+}
+
+// Wait for changes under a prefix after a log index. Changes the client may
+// not see are left out.
+func (h *Handler) Watch(req api.WatchRequest, res *api.WatchResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	events, nextIndex, compacted, err := sess.Watch(req.Prefix, req.FromIndex, req.Timeout)
+	if err != nil {
+		return err
+	}
+	res.Compacted = compacted
+	res.NextIndex = nextIndex
+	res.Events = []api.WatchEvent{}
+	for _, e := range events {
+		node := e.Event.Filepath
+		if e.Event.Child != "" {
+			node = e.Event.Child
+		}
+		if canSee(req.ClientID, node) {
+			res.Events = append(res.Events, e)
+		}
+	}
+	return nil
+}
+
+// Get the metadata of a file or directory.
+func (h *Handler) Stat(req api.StatRequest, res *api.StatResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
 	}
-	err := sess.OpenLock(req.Filepath)
+	stat, err := sess.Stat(path)
 	if err != nil {
 		return err
 	}
+	res.Stat = stat
 	return nil
 }
 
 // Delete a lock.
 func (h *Handler) DeleteLock(req api.DeleteLockRequest, res *api.DeleteLockResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
 	}
-	err := sess.DeleteLock(req.Filepath)
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	err = sess.DeleteLock(path)
 	if err != nil {
 		return err
 	}
@@ -127,11 +349,56 @@ func (h *Handler) DeleteLock(req api.DeleteLockRequest, res *api.DeleteLockRespo
 
 // Try to acquire a lock.
 func (h *Handler) TryAcquireLock(req api.TryAcquireLockRequest, res *api.TryAcquireLockResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, lockOpenMode(req.Mode))
+	if err != nil {
+		return err
+	}
+	isSuccessful, err := sess.TryAcquireLock(path, req.Mode)
+	if err != nil {
+		return err
+	}
+	res.IsSuccessful = isSuccessful
+	return nil
+}
+
+// Try to acquire several locks at once: either all of them or none.
+func (h *Handler) TryAcquireLocks(req api.TryAcquireLocksRequest, res *api.TryAcquireLocksResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	paths := make([]api.FilePath, len(req.Locks))
+	modes := make([]api.LockMode, len(req.Locks))
+	for i, l := range req.Locks {
+		paths[i], err = sess.checkHandle(l.Handle, lockOpenMode(l.Mode))
+		if err != nil {
+			return err
+		}
+		modes[i] = l.Mode
+	}
+	isSuccessful, err := sess.TryAcquireLocks(paths, modes)
+	if err != nil {
+		return err
+	}
+	res.IsSuccessful = isSuccessful
+	return nil
+}
+
+// Acquire a lock, blocking until it is granted or the request times out.
+func (h *Handler) AcquireLock(req api.AcquireLockRequest, res *api.AcquireLockResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
 	}
-	isSuccessful, err := sess.TryAcquireLock(req.Filepath, req.Mode)
+	path, err := sess.checkHandle(req.Handle, lockOpenMode(req.Mode))
+	if err != nil {
+		return err
+	}
+	isSuccessful, err := sess.AcquireLock(path, req.Mode, req.Timeout)
 	if err != nil {
 		return err
 	}
@@ -141,42 +408,267 @@ func (h *Handler) TryAcquireLock(req api.TryAcquireLockRequest, res *api.TryAcqu
 
 // Release lock.
 func (h *Handler) ReleaseLock(req api.ReleaseLockRequest, res *api.ReleaseLockResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	// Any handle will do: a client may always give up a lock it holds,
+	// even after losing access to the file.
+	path, err := sess.checkHandle(req.Handle, 0)
+	if err != nil {
+		return err
+	}
+	err = sess.ReleaseLock(path)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Set the scheduling policy of a lock.
+func (h *Handler) SetLockPolicy(req api.SetLockPolicyRequest, res *api.SetLockPolicyResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	return sess.SetLockPolicy(path, req.Policy)
+}
+
+// Upgrade a SHARED lock to EXCLUSIVE mode.
+func (h *Handler) UpgradeLock(req api.UpgradeLockRequest, res *api.UpgradeLockResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	isSuccessful, err := sess.UpgradeLock(path, req.Timeout)
+	if err != nil {
+		return err
+	}
+	res.IsSuccessful = isSuccessful
+	return nil
+}
+
+// Downgrade an EXCLUSIVE lock to SHARED mode.
+func (h *Handler) DowngradeLock(req api.DowngradeLockRequest, res *api.DowngradeLockResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	// Any handle will do: a client may always give up a lock it holds,
+	// even after losing access to the file.
+	path, err := sess.checkHandle(req.Handle, 0)
+	if err != nil {
+		return err
+	}
+	return sess.DowngradeLock(path)
+}
+
+// Set the lock-delay of a held lock.
+func (h *Handler) SetLockDelay(req api.SetLockDelayRequest, res *api.SetLockDelayResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	return sess.SetLockDelay(path, req.LockDelay)
+}
+
+// Get a sequencer for a held lock.
+func (h *Handler) GetSequencer(req api.GetSequencerRequest, res *api.GetSequencerResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	sequencer, err := sess.GetSequencer(path)
+	if err != nil {
+		return err
+	}
+	res.Sequencer = sequencer
+	return nil
+}
+
+// Check whether a sequencer is still valid.
+func (h *Handler) CheckSequencer(req api.CheckSequencerRequest, res *api.CheckSequencerResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	// A sequencer for a deleted lock is simply invalid.
+	if app.store.Exists(string(req.Sequencer.LockName)) {
+		if err := checkPermission(req.ClientID, req.Sequencer.LockName, api.READ); err != nil {
+			return err
+		}
 	}
-	err := sess.ReleaseLock(req.Filepath)
+	isValid, err := sess.CheckSequencer(req.Sequencer)
 	if err != nil {
 		return err
 	}
+	res.IsValid = isValid
 	return nil
 }
 
 // Read Content
 func (h *Handler) ReadContent(req api.ReadRequest, res *api.ReadResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
 	}
-	content, err := sess.ReadContent(req.Filepath)
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	content, cacheable, err := sess.ReadContent(path)
 	if err != nil {
 		return err
 	}
 	res.Content = content
+	res.Cacheable = cacheable
 	return  nil
 }
 
 // Read Content
 func (h *Handler) WriteContent(req api.WriteRequest, res *api.WriteResponse) error {
-	sess, ok := app.sessions[req.ClientID]
-	if !ok {
-		return errors.New(fmt.Sprintf("No session exists for %s", req.ClientID))
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
 	}
-	err := sess.WriteContent (req.Filepath, req.Content)
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	err = sess.WriteContent (path, req.Content)
 	if err != nil {
 		res.IsSuccessful = false
-		return  err
+		return limitError(err, &res.LimitError)
 	}
 	res.IsSuccessful = true
 	return nil
-}
\ No newline at end of file
+}
+
+// Write Content if the content generation matches
+func (h *Handler) CompareAndSetContent(req api.CompareAndSetRequest, res *api.CompareAndSetResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_WRITE)
+	if err != nil {
+		return err
+	}
+	isSuccessful, generation, err := sess.CompareAndSetContent(path, req.Content, req.ExpectedGeneration)
+	if err != nil {
+		return limitError(err, &res.LimitError)
+	}
+	res.IsSuccessful = isSuccessful
+	res.ContentGeneration = generation
+	return nil
+}
+
+// Get the ACL names of a file or directory.
+func (h *Handler) GetACL(req api.GetACLRequest, res *api.GetACLResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_READ)
+	if err != nil {
+		return err
+	}
+	acl, err := sess.GetACL(path)
+	if err != nil {
+		return err
+	}
+	res.ACL = acl
+	return nil
+}
+
+// Set the ACL names of a file or directory.
+func (h *Handler) SetACL(req api.SetACLRequest, res *api.SetACLResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_CHANGE_ACL)
+	if err != nil {
+		return err
+	}
+	return sess.SetACL(path, req.ACL)
+}
+
+// Mark a file as mandatory, or clear the mark.
+func (h *Handler) SetMandatory(req api.SetMandatoryRequest, res *api.SetMandatoryResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	path, err := sess.checkHandle(req.Handle, api.OPEN_CHANGE_ACL)
+	if err != nil {
+		return err
+	}
+	return sess.SetMandatory(path, req.Mandatory)
+}
+
+// Apply several operations atomically if all the guards hold.
+// Like CreateDirectory and Find, it names nodes by path rather than by
+// handle: its creates and guards may name nodes that do not exist yet, so
+// the ACLs are checked here for each of them.
+func (h *Handler) Txn(req api.TxnRequest, res *api.TxnResponse) error {
+	sess, err := lookupSession(req.ClientID)
+	if err != nil {
+		return err
+	}
+	// Missing nodes are reported by the transaction itself.
+	for _, g := range req.Guards {
+		if app.store.Exists(string(g.Filepath)) {
+			if err := checkPermission(req.ClientID, g.Filepath, api.READ); err != nil {
+				return err
+			}
+		}
+	}
+	for _, op := range req.Ops {
+		var err error
+		if op.Type == api.TXN_CREATE {
+			err = checkCreatePermission(req.ClientID, op.Filepath)
+		} else if app.store.Exists(string(op.Filepath)) {
+			err = checkPermission(req.ClientID, op.Filepath, api.WRITE)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	isSuccessful, err := sess.Txn(req.Guards, req.Ops)
+	if err != nil {
+		return limitError(err, &res.LimitError)
+	}
+	res.IsSuccessful = isSuccessful
+	return nil
+}
+
+// Send quota and size errors back in the response rather than as an RPC
+// error, so that the client can return them typed. Returns any other error.
+func limitError(err error, res *api.LimitError) error {
+	switch e := err.(type) {
+	case *api.QuotaExceededError:
+		res.QuotaExceeded = e
+		return nil
+	case *api.FileTooLargeError:
+		res.FileTooLarge = e
+		return nil
+	}
+	return err
+}
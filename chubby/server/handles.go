@@ -0,0 +1,221 @@
+// Chubby handles.
+//
+// Open checks the ACLs of a node once and returns a handle recording the
+// access granted. Later operations present the handle instead of a path.
+// Handles carry check digits, a MAC over their fields keyed by the cell
+// secret, so that clients cannot forge them. The secret is replicated
+// through Raft, so a new master can check the handles issued by the previous
+// one when clients re-establish them after a failover.
+
+package server
+
+import (
+	"cos518project/chubby/api"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Size of the cell secret in bytes.
+const SecretSize = 32
+
+// An open handle, as the master records it.
+type handle struct {
+	api.Handle
+	events		api.EventType  // Events subscribed to through the handle.
+}
+
+// Set the cell secret if no master has set it yet. Called on becoming leader.
+func ensureSecret() {
+	if app.store.Secret() != nil {
+		return
+	}
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		app.logger.Printf("error when generating cell secret: %s", err.Error())
+		return
+	}
+	if err := app.store.SetSecret(secret); err != nil {
+		app.logger.Printf("error when setting cell secret: %s", err.Error())
+	}
+}
+
+// Compute the check digits of a handle.
+func checkDigits(h api.Handle) (uint64, error) {
+	secret := app.store.Secret()
+	if secret == nil {
+		return 0, errors.New("Cell secret is not set yet")
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\x00%d\x00%s\x00%d\x00%d", h.ClientID, h.ID, h.Path, h.Instance, h.Mode)
+	return binary.BigEndian.Uint64(mac.Sum(nil)), nil
+}
+
+// Returns an error unless the handle was issued to this client by a master
+// of this cell.
+func (sess *Session) verifyHandle(h api.Handle) error {
+	digits, err := checkDigits(h)
+	if err != nil {
+		return err
+	}
+	if h.ClientID != sess.clientID || h.CheckDigits != digits {
+		return errors.New(fmt.Sprintf("Invalid handle %d for %s", h.ID, h.Path))
+	}
+	return nil
+}
+
+// Check that a handle is valid and open, that it was opened with every
+// access in mode, and that the node it was opened on still exists. Returns
+// the path of the node.
+func (sess *Session) checkHandle(h api.Handle, mode api.OpenMode) (api.FilePath, error) {
+	if err := sess.verifyHandle(h); err != nil {
+		return "", err
+	}
+
+	app.lockMu.Lock()
+	_, open := sess.handles[h.ID]
+	app.lockMu.Unlock()
+	if !open {
+		return "", errors.New(fmt.Sprintf("Handle %d for %s is closed", h.ID, h.Path))
+	}
+
+	if h.Mode & mode != mode {
+		return "", errors.New(fmt.Sprintf("Handle %d for %s was not opened for this access", h.ID, h.Path))
+	}
+
+	// A handle refers to the node it was opened on, not to a later node
+	// with the same name.
+	stat, err := app.store.Stat(string(h.Path))
+	if err != nil || stat.InstanceNumber != h.Instance {
+		return "", errors.New(fmt.Sprintf("Node at %s opened by handle %d no longer exists", h.Path, h.ID))
+	}
+	return h.Path, nil
+}
+
+// Open a file or directory. A file that does not exist is created if flags
+// include api.OPEN_CREATE, as a semaphore if capacity is positive. The
+// caller has checked that the client may open the node with the given mode.
+func (sess *Session) Open(path api.FilePath, mode api.OpenMode, flags api.OpenFlag, capacity int) (api.Handle, error) {
+	// Directories have no lock to open.
+	if !app.store.IsDir(string(path)) {
+		if !app.store.Exists(string(path)) && flags & api.OPEN_CREATE == 0 {
+			return api.Handle{}, errors.New(fmt.Sprintf("File at %s does not exist", path))
+		}
+		err := sess.OpenLock(path, capacity, flags & api.OPEN_EPHEMERAL != 0)
+		if err != nil {
+			return api.Handle{}, err
+		}
+	}
+
+	stat, err := app.store.Stat(string(path))
+	if err != nil {
+		return api.Handle{}, err
+	}
+
+	// Runs after the unlock below.
+	defer sess.persist()
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	sess.lastHandle++
+	h := api.Handle{
+		ClientID: sess.clientID,
+		ID: sess.lastHandle,
+		Path: path,
+		Instance: stat.InstanceNumber,
+		Mode: mode,
+	}
+	h.CheckDigits, err = checkDigits(h)
+	if err != nil {
+		return api.Handle{}, err
+	}
+	sess.handles[h.ID] = &handle{Handle: h}
+	return h, nil
+}
+
+// Close a handle. Once the session has no handle left on a file, its lock
+// is released, and it is deleted if it is an ephemeral file that no other
+// session has open.
+func (sess *Session) Close(h api.Handle) error {
+	if err := sess.verifyHandle(h); err != nil {
+		return err
+	}
+
+	// Runs after the unlock below.
+	defer sess.persist()
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	closed, open := sess.handles[h.ID]
+	if !open {
+		return errors.New(fmt.Sprintf("Handle %d for %s is closed", h.ID, h.Path))
+	}
+	delete(sess.handles, h.ID)
+
+	// Events subscribed to through the handle end with it.
+	var events api.EventType
+	stillOpen := false
+	for _, other := range sess.handles {
+		if other.Path == h.Path {
+			stillOpen = true
+			events |= other.events
+		}
+	}
+	if closed.events != 0 {
+		sess.Subscribe(h.Path, events)
+	}
+	if stillOpen || !sess.opened[h.Path] {
+		return nil
+	}
+	if lock := lookupLock(h.Path); lock.owners[sess.clientID] {
+		if err := sess.releaseLock(h.Path); err != nil {
+			return err
+		}
+	}
+	delete(sess.opened, h.Path)
+	if app.store.IsEphemeral(string(h.Path)) && !isOpen(h.Path) {
+		app.logger.Printf("Deleting ephemeral file %s: no session has it open", h.Path)
+		return deleteLock(lookupLock(h.Path))
+	}
+	return nil
+}
+
+// Record the events subscribed to through a handle.
+func (sess *Session) setHandleEvents(h api.Handle, events api.EventType) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if open, exists := sess.handles[h.ID]; exists {
+		open.events = events
+	}
+}
+
+// Re-establish the handles a client had open with the previous master after
+// a failover. Handles that fail their check digits, or whose node is gone,
+// are dropped: the client gets an error when it next uses them.
+func (sess *Session) RecoverHandles(handles []api.Handle) {
+	for _, h := range handles {
+		if err := sess.verifyHandle(h); err != nil {
+			app.logger.Printf("Client %s presented an invalid handle for %s", sess.clientID, h.Path)
+			continue
+		}
+		stat, err := app.store.Stat(string(h.Path))
+		if err != nil || stat.InstanceNumber != h.Instance {
+			continue
+		}
+
+		app.lockMu.Lock()
+		sess.handles[h.ID] = &handle{Handle: h}
+		if h.ID > sess.lastHandle {
+			sess.lastHandle = h.ID
+		}
+		if stat.Type == api.FILE {
+			sess.opened[h.Path] = true
+		}
+		app.lockMu.Unlock()
+	}
+	sess.persist()
+}
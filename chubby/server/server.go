@@ -19,11 +19,14 @@ import (
 	"cos518project/chubby/config"
 	"cos518project/chubby/store"
 	"cos518project/chubby/api"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"sync"
+	"time"
 )
 
 type App struct {
@@ -45,8 +48,27 @@ type App struct {
 	// Maps filepaths to Lock structs.
 	locks map[api.FilePath]*Lock
 
+	// Protects the locks struct and the waiter queues of each lock.
+	lockMu sync.Mutex
+
 	// In-memory struct of sessions.
 	sessions map[api.ClientID]*Session
+
+	// Protects the sessions map. Events are queued from the FSM while RPCs
+	// add and remove sessions, so never hold it while taking another lock.
+	sessionMu sync.Mutex
+
+	// Most locks a session may have open, or 0 for no limit.
+	maxLocksPerSession int
+
+	// Sessions caching the content of each file; see cache.go.
+	cachers map[api.FilePath]map[*Session]bool
+
+	// Number of invalidations in flight. Reads are not cacheable meanwhile.
+	invalidating int
+
+	// Protects cachers and invalidating.
+	cacheMu sync.Mutex
 }
 
 // No choice but to make this variable package-level :(
@@ -58,11 +80,16 @@ func Run(conf *config.Config) {
 	// Init app struct.
 	app = &App{
 		logger:		log.New(os.Stderr, "[server] ", log.LstdFlags),
-		store:		store.New(conf.RaftDir, conf.RaftBind, conf.InMem),
+		store:		store.New(conf.RaftDir, conf.RaftBind, conf.InMem, conf.MaxFileSize),
 		address: 	conf.Listen,
 		locks:		make(map[api.FilePath]*Lock),
 		sessions:	make(map[api.ClientID]*Session),
+		maxLocksPerSession:	conf.Quotas.MaxLocksPerSession,
+		cachers:	make(map[api.FilePath]map[*Session]bool),
 	}
+	app.store.MaxNodesPerDir = conf.Quotas.MaxNodesPerDir
+	app.store.MaxSubtreeBytes = conf.Quotas.MaxSubtreeBytes
+	app.store.Notify = queueEvent
 
 	// Open the store.
 	bootstrap := conf.Join == ""
@@ -95,6 +122,9 @@ func Run(conf *config.Config) {
 		}
 	}
 
+	// Rebuild in-memory lock structs whenever leadership changes.
+	go monitorLeadership()
+
 	// Listen for client connections.
 	handler := new(Handler)
 	err = rpc.Register(handler)
@@ -108,3 +138,32 @@ func Run(conf *config.Config) {
 	// Accept connections.
 	rpc.Accept(app.listener)
 }
+
+// Watch for this node gaining or losing leadership. In-memory lock structs
+// and sessions may be stale after a change, so drop them and rebuild them
+// from the replicated lock table and session records.
+func monitorLeadership() {
+	for isLeader := range app.store.Raft.LeaderCh() {
+		app.lockMu.Lock()
+		for _, lock := range app.locks {
+			lock.failWaiters(errors.New("Leadership changed"))
+		}
+		app.locks = make(map[api.FilePath]*Lock)
+		app.lockMu.Unlock()
+
+		// Clients flush their caches when they fail over to a new master.
+		app.cacheMu.Lock()
+		app.cachers = make(map[api.FilePath]map[*Session]bool)
+		app.cacheMu.Unlock()
+
+		abandonSessions()
+
+		if isLeader {
+			restoreSessions()
+			go ensureSecret()
+
+			app.logger.Printf("Became leader: releasing orphaned locks in %s", FailoverGracePeriod.String())
+			time.AfterFunc(FailoverGracePeriod, releaseOrphanedLocks)
+		}
+	}
+}
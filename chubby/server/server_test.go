@@ -0,0 +1,189 @@
+package server
+
+import (
+	"cos518project/chubby/api"
+	"cos518project/chubby/store"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Set up the app with a single-node store that leads its own cluster, as
+// Run does, but without serving RPCs.
+func newTestApp(t *testing.T) {
+	t.Helper()
+
+	// Raft needs an address it can advertise.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raftBind := l.Addr().String()
+	l.Close()
+
+	app = &App{
+		logger:		log.New(io.Discard, "", 0),
+		store:		store.New(t.TempDir(), raftBind, true, 0),
+		locks:		make(map[api.FilePath]*Lock),
+		sessions:	make(map[api.ClientID]*Session),
+		cachers:	make(map[api.FilePath]map[*Session]bool),
+	}
+	app.store.Notify = queueEvent
+	if err := app.store.Open(true, "node0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		app.store.Raft.Shutdown().Error()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for app.store.Raft.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("store did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Add a session for the client. Unlike CreateSession, it does not monitor
+// the lease, which would outlive the test.
+func newTestSession(t *testing.T, clientID api.ClientID) *Session {
+	t.Helper()
+	sess := newSession(clientID)
+	if !addSession(sess) {
+		t.Fatalf("client %s already has a session", clientID)
+	}
+	return sess
+}
+
+// Open the lock at path for each of the sessions.
+func openTestLock(t *testing.T, path api.FilePath, capacity int, sessions ...*Session) {
+	t.Helper()
+	for _, sess := range sessions {
+		if err := sess.OpenLock(path, capacity, false); err != nil {
+			t.Fatalf("open %s: %s", path, err.Error())
+		}
+	}
+}
+
+// Acquire a lock that must be free to take right away.
+func mustAcquire(t *testing.T, sess *Session, path api.FilePath, mode api.LockMode) {
+	t.Helper()
+	ok, err := sess.TryAcquireLock(path, mode)
+	if err != nil {
+		t.Fatalf("%s acquiring %s: %s", sess.clientID, path, err.Error())
+	}
+	if !ok {
+		t.Fatalf("%s could not acquire %s", sess.clientID, path)
+	}
+}
+
+func mustRelease(t *testing.T, sess *Session, path api.FilePath) {
+	t.Helper()
+	if err := sess.ReleaseLock(path); err != nil {
+		t.Fatalf("%s releasing %s: %s", sess.clientID, path, err.Error())
+	}
+}
+
+// Outcome of a blocking lock request.
+type acquireResult struct {
+	ok  bool
+	err error
+}
+
+// Start a blocking AcquireLock, or UpgradeLock if upgrade is set, and wait
+// until the session is queued on the lock. The request is failed when the
+// test ends, if it is still waiting.
+func startAcquire(t *testing.T, sess *Session, path api.FilePath, mode api.LockMode, upgrade bool) <-chan acquireResult {
+	t.Helper()
+	queued := waiterCount(path)
+	done := make(chan acquireResult, 1)
+	finished := make(chan struct{})
+	go func() {
+		var res acquireResult
+		if upgrade {
+			res.ok, res.err = sess.UpgradeLock(path, time.Minute)
+		} else {
+			res.ok, res.err = sess.AcquireLock(path, mode, time.Minute)
+		}
+		done <- res
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		app.lockMu.Lock()
+		if lock, exists := app.locks[path]; exists {
+			lock.failWaiters(errors.New("test ended"))
+		}
+		app.lockMu.Unlock()
+		<-finished
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for waiterCount(path) <= queued {
+		select {
+		case res := <-done:
+			t.Fatalf("%s did not queue for %s: got %v, %v", sess.clientID, path, res.ok, res.err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not queue for %s", sess.clientID, path)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+// Wait for a blocking request to be granted.
+func wantGranted(t *testing.T, sess *Session, done <-chan acquireResult) {
+	t.Helper()
+	select {
+	case res := <-done:
+		if !res.ok || res.err != nil {
+			t.Fatalf("%s: got %v, %v, want the lock", sess.clientID, res.ok, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was not granted the lock", sess.clientID)
+	}
+}
+
+// Returns the number of sessions queued on the lock.
+func waiterCount(path api.FilePath) int {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+	if lock, exists := app.locks[path]; exists {
+		return len(lock.waiters)
+	}
+	return 0
+}
+
+// Returns the clients holding the lock, in order, and its mode.
+func holders(path api.FilePath) ([]api.ClientID, api.LockMode) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+	lock := lookupLock(path)
+	owners := []api.ClientID{}
+	for owner := range lock.owners {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i] < owners[j] })
+	return owners, lock.mode
+}
+
+// Check who holds the lock, and in which mode.
+func wantHolders(t *testing.T, path api.FilePath, mode api.LockMode, want ...api.ClientID) {
+	t.Helper()
+	got, gotMode := holders(path)
+	if len(want) == 0 {
+		want = []api.ClientID{}
+	}
+	if !reflect.DeepEqual(got, want) || gotMode != mode {
+		t.Errorf("%s: got holders %v in mode %d, want %v in mode %d", path, got, gotMode, want, mode)
+	}
+}
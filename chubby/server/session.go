@@ -5,6 +5,7 @@ package server
 
 import (
 	"cos518project/chubby/api"
+	"cos518project/chubby/store"
 	"errors"
 	"fmt"
 	"log"
@@ -14,6 +15,16 @@ import (
 
 const DefaultLeaseExt = 15 * time.Second
 
+// After a lock is released because its holder's session ended, nobody else
+// may acquire it for the lock-delay period.
+const DefaultLockDelay = 10 * time.Second
+const MaxLockDelay = 1 * time.Minute
+
+// How long a new leader waits for clients to re-establish their sessions
+// before releasing locks they held with the previous leader. This matches
+// the jeopardy period of the client library.
+const FailoverGracePeriod = 45 * time.Second
+
 // Session contains metadata for one Chubby session.
 // For simplicity, we say that each client can only init one session with
 // the Chubby servers.
@@ -37,6 +48,45 @@ type Session struct {
     // Maps lock filepath -> Lock struct.
     locks           map[api.FilePath]*Lock
 
+	// Files the client has open through at least one handle.
+	opened			map[api.FilePath]bool
+
+	// Open handles by ID, and the last ID handed out; see handles.go.
+	// Protected by app.lockMu.
+	handles			map[uint64]*handle
+	lastHandle		uint64
+
+	// Events the client subscribed to on each node.
+	subscriptions	map[api.FilePath]api.EventType
+
+	// Events waiting for the next KeepAlive response.
+	events			[]api.Event
+
+	// Cache invalidations waiting for the next KeepAlive response.
+	invalidations	[]api.FilePath
+
+	// Closed when the client acknowledges the invalidation of each file.
+	unacked			map[api.FilePath][]chan struct{}
+
+	// Protects subscriptions, events and invalidations.
+	eventMu			sync.Mutex
+
+	// Signalled when an event or invalidation is queued, to return the
+	// KeepAlive early.
+	eventChan		chan struct{}
+
+	// Restored from the session records after a failover, and waiting
+	// for the client's first KeepAlive; see failover.go.
+	recovering		bool
+
+	// Closed once a restored session completes its handshake; closed from
+	// the start for other sessions.
+	recoveredChan	chan struct{}
+
+	// When the lease the old master granted runs out. Until then, a
+	// restored session may still be reading from its cache.
+	cacheExpiry		time.Time
+
 	// Did we terminate this session?
 	terminated		bool
 
@@ -49,39 +99,104 @@ type Lock struct {
 	path			api.FilePath  // The path to this lock in the store.
 	mode			api.LockMode  // api.SHARED or exclusive lock?
 	owners			map[api.ClientID]bool  // Who is holding the lock?
-	content         string                 // The content of the file
+	generation      uint64                 // Bumped every time the lock goes from free to held, and on upgrades.
+	lockDelay       time.Duration          // Quiet period after a non-voluntary release.
+	policy          api.LockPolicy         // How SHARED and EXCLUSIVE requests are scheduled.
+	capacity        int                    // Maximum number of holders if the lock is a semaphore, else 0.
+	delayedUntil    time.Time              // Acquires fail until this time.
+	waiters         []*lockWaiter          // Sessions blocked in AcquireLock, in FIFO order.
+}
+
+// lockWaiter describes a session blocked in AcquireLock.
+type lockWaiter struct {
+	sess			*Session
+	mode			api.LockMode
+	upgrade			bool           // Is the waiter upgrading a SHARED lock it holds?
+	ready			chan struct{}  // Closed once the waiter is granted the lock or fails.
+	err				error          // Why the waiter failed, if it did.
 }
 
 /* Create Session struct. */
 func CreateSession(clientID api.ClientID) (*Session, error) {
-	sess, ok := app.sessions[clientID]
+	app.logger.Printf("Creating session with client %s", clientID)
+
+	// Create new session struct.
+	sess := newSession(clientID)
 
-	if ok  {
+	// Add the session to the sessions map.
+	if !addSession(sess) {
 		return nil, errors.New(fmt.Sprintf("The client already has a session established with the master"))
 	}
+	sess.persist()
+
+	// In a separate goroutine, periodically check if the lease is over
+    go sess.MonitorSession()
 
+    return sess, nil
+}
 
+// Look up the session of a client.
+func getSession(clientID api.ClientID) (*Session, bool) {
+	app.sessionMu.Lock()
+	defer app.sessionMu.Unlock()
 
-	app.logger.Printf("Creating session with client %s", clientID)
+	sess, ok := app.sessions[clientID]
+	return sess, ok
+}
 
-	// Create new session struct.
-	sess = &Session{
+// Returns the sessions, as of now.
+func allSessions() []*Session {
+	app.sessionMu.Lock()
+	defer app.sessionMu.Unlock()
+
+	sessions := make([]*Session, 0, len(app.sessions))
+	for _, sess := range app.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Add a session unless the client already has one. Returns whether it was
+// added.
+func addSession(sess *Session) bool {
+	app.sessionMu.Lock()
+	defer app.sessionMu.Unlock()
+
+	if _, ok := app.sessions[sess.clientID]; ok {
+		return false
+	}
+	app.sessions[sess.clientID] = sess
+	return true
+}
+
+// Remove the session of a client.
+func removeSession(clientID api.ClientID) {
+	app.sessionMu.Lock()
+	defer app.sessionMu.Unlock()
+
+	delete(app.sessions, clientID)
+}
+
+// Returns a new Session struct with a fresh lease.
+func newSession(clientID api.ClientID) *Session {
+	recovered := make(chan struct{})
+	close(recovered)
+
+	return &Session{
         clientID:    	clientID,
         startTime:   	time.Now(),
         leaseLength: 	DefaultLeaseExt,
         ttlChannel:  	make(chan struct{}, 2),
         locks:       	make(map[api.FilePath]*Lock),
+        opened:      	make(map[api.FilePath]bool),
+        handles:     	make(map[uint64]*handle),
+        subscriptions:	make(map[api.FilePath]api.EventType),
+        eventChan:   	make(chan struct{}, 1),
+        unacked:     	make(map[api.FilePath][]chan struct{}),
         terminated:	 	false,
         terminatedChan: make(chan struct{}, 2),
+        recoveredChan:  recovered,
     }
-
-	// Add the session to the sessions map.
-	app.sessions[clientID] = sess
-
-	// In a separate goroutine, periodically check if the lease is over
-    go sess.MonitorSession()
-
-    return sess, nil
 }
 
 func (sess *Session) MonitorSession() {
@@ -90,6 +205,11 @@ func (sess *Session) MonitorSession() {
 	// At each second, check time until the lease is over.
 	ticker := time.Tick(time.Second)
 	for range ticker {
+		// Ended, or dropped when this node lost leadership.
+		if sess.terminated {
+			return
+		}
+
 		timeLeaseOver := sess.startTime.Add(sess.leaseLength)
 
 		var durationLeaseOver time.Duration = 0
@@ -116,12 +236,24 @@ func (sess *Session) TerminateSession() {
 	// We can't justs delete the session from the app session map because
 	// We cannot delete the session from the app session map because
 	// Chubby could have experienced a failover event.
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if sess.terminated {
+		return
+	}
 	sess.terminated = true
 	close(sess.terminatedChan)
 
 	// Release all the locks in the session.
+	// The holder did not release these locks voluntarily, so start the
+	// lock-delay before waiters on these locks are woken up by releaseLock.
 	for filePath := range sess.locks {
-		err := sess.ReleaseLock(filePath)
+		lock := lookupLock(filePath)
+		if lock.owners[sess.clientID] {
+			lock.startLockDelay()
+		}
+		err := sess.releaseLock(filePath)
 		if err != nil {
 			app.logger.Printf(
 				"error when client %s releasing lock at %s: %s",
@@ -131,9 +263,131 @@ func (sess *Session) TerminateSession() {
 		}
 	}
 
+	// Ephemeral files that nobody else has open go away with the session.
+	sess.deleteEphemeralFiles()
+
+	// The client's cache is no longer valid.
+	sess.dropCacher()
+
+	// The next master must not restore the session.
+	err := app.store.DeleteSession(sess.clientID)
+	if err != nil {
+		app.logger.Printf("error when deleting record of session with client %s: %s", sess.clientID, err.Error())
+	}
+
 	app.logger.Printf("terminated session with client %s", sess.clientID)
 }
 
+// Rebuild the locks held by the session from the replicated lock table after
+// a failover. Returns false if the client claims to hold a lock that the lock
+// table does not record it as holding in the same mode.
+func (sess *Session) RecoverLocks(claimed map[api.FilePath]api.LockMode) bool {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	for key, state := range app.store.Locks() {
+		if state.Owners[sess.clientID] {
+			path := api.FilePath(key)
+			sess.locks[path] = lookupLock(path)
+			app.logger.Printf("Lock %s recovered for client %s", path, sess.clientID)
+		}
+	}
+
+	for filePath, lockMode := range claimed {
+		lock, held := sess.locks[filePath]
+		if !held || lock.mode != lockMode {
+			app.logger.Printf("Client %s claims lock %s that it does not hold", sess.clientID, filePath)
+			return false
+		}
+	}
+	return true
+}
+
+// Release locks that the lock table records as held by the client from an
+// earlier session. The client started over, so it cannot be using them.
+func (sess *Session) ReleaseStaleLocks() {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	for key, state := range app.store.Locks() {
+		if !state.Owners[sess.clientID] {
+			continue
+		}
+		lock := lookupLock(api.FilePath(key))
+		lock.startLockDelay()
+		err := lock.release(sess.clientID)
+		if err != nil {
+			app.logger.Printf("error when releasing stale lock %s of client %s: %s", key, sess.clientID, err.Error())
+		}
+	}
+}
+
+// Release locks in the lock table whose holders did not re-establish a
+// session with this leader within the fail-over grace period.
+func releaseOrphanedLocks() {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if app.store.RaftBind != string(app.store.Raft.Leader()) {
+		return
+	}
+
+	for key, state := range app.store.Locks() {
+		for owner := range state.Owners {
+			if _, ok := getSession(owner); ok {
+				continue
+			}
+			app.logger.Printf("Client %s did not come back after failover: releasing lock %s", owner, key)
+			lock := lookupLock(api.FilePath(key))
+			lock.startLockDelay()
+			err := lock.release(owner)
+			if err != nil {
+				app.logger.Printf("error when releasing orphaned lock %s: %s", key, err.Error())
+			}
+		}
+	}
+
+	// Which sessions had an ephemeral file open was only known to the old
+	// leader, so keep the file only if its creator came back.
+	for key, owner := range app.store.EphemeralFiles() {
+		if _, ok := getSession(owner); ok {
+			continue
+		}
+		app.logger.Printf("Client %s did not come back after failover: deleting ephemeral file %s", owner, key)
+		err := deleteLock(lookupLock(api.FilePath(key)))
+		if err != nil {
+			app.logger.Printf("error when deleting orphaned ephemeral file %s: %s", key, err.Error())
+		}
+	}
+}
+
+// Delete the ephemeral files opened by the session that no other live
+// session has open. Caller must hold app.lockMu.
+func (sess *Session) deleteEphemeralFiles() {
+	for path := range sess.opened {
+		delete(sess.opened, path)
+		if !app.store.IsEphemeral(string(path)) || isOpen(path) {
+			continue
+		}
+		app.logger.Printf("Deleting ephemeral file %s: no session has it open", path)
+		err := deleteLock(lookupLock(path))
+		if err != nil {
+			app.logger.Printf("error when deleting ephemeral file %s: %s", path, err.Error())
+		}
+	}
+}
+
+// Returns whether any live session has the file open.
+// Caller must hold app.lockMu.
+func isOpen(path api.FilePath) bool {
+	for _, s := range allSessions() {
+		if !s.terminated && s.opened[path] {
+			return true
+		}
+	}
+	return false
+}
+
 // Extend Lease after receiving keepalive messages
 func (sess *Session) KeepAlive(clientID api.ClientID) (time.Duration) {
 	// Block until shortly before lease expires
@@ -142,9 +396,15 @@ func (sess *Session) KeepAlive(clientID api.ClientID) (time.Duration) {
 		// Return early response saying that session should end.
 		return sess.leaseLength
 
+	case <- sess.eventChan:
+		// Return early to deliver events, without extending the lease.
+		return sess.leaseLength
+
 	case <- sess.ttlChannel:
-		// Extend lease by 12 seconds
+		// Extend lease by 12 seconds, recording the extension before the
+		// client hears of it so that a new master honours it.
 		sess.leaseLength = sess.leaseLength + DefaultLeaseExt
+		sess.persist()
 
 		app.logger.Printf(
 			"session with client %s extended: lease length %s",
@@ -157,97 +417,620 @@ func (sess *Session) KeepAlive(clientID api.ClientID) (time.Duration) {
 }
 
 // Create the lock if it does not exist.
-func (sess *Session) OpenLock(path api.FilePath) error {
+// If capacity is positive, the lock is a semaphore that up to capacity
+// sessions may hold at once in api.SEMAPHORE mode. If ephemeral is set and
+// the lock is created, it is deleted once no session has it open.
+func (sess *Session) OpenLock(path api.FilePath, capacity int, ephemeral bool) error {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if capacity < 0 {
+		return errors.New(fmt.Sprintf("Invalid semaphore capacity %d", capacity))
+	}
+
+	if !sess.opened[path] && app.maxLocksPerSession > 0 && len(sess.opened) >= app.maxLocksPerSession {
+		return &store.QuotaExceededError{
+			Quota: store.QuotaLocksPerSession,
+			Key: string(sess.clientID),
+			Usage: len(sess.opened) + 1,
+			Limit: app.maxLocksPerSession,
+		}
+	}
+
 	// Check if lock exists in persistent store
 	_, err := app.store.Get(string(path))
-	if err != nil {
+	if err == nil {
+		// Opening an existing lock must not change what kind of lock it is.
+		lock := lookupLock(path)
+		if capacity > 0 && lock.capacity != capacity {
+			return errors.New(fmt.Sprintf("Lock at %s already exists with capacity %d", path, lock.capacity))
+		}
+	} else {
 		// Add lock to persistent store: (key: LockPath, value: "")
-		err = app.store.Set(string(path), "")
+		if ephemeral {
+			err = app.store.CreateEphemeral(string(path), sess.clientID)
+		} else {
+			err = app.store.Set(string(path), nil)
+		}
 		if err != nil {
 			return err
 		}
 
-		// Add lock to in-memory struct of locks
+		// Add lock to in-memory struct of locks and to the lock table.
+		// A lock with the same name may have existed before: keep its
+		// generation number so that old sequencers stay invalid.
 		lock := &Lock{
 			path: path,
 			mode: api.FREE,
 			owners: make(map[api.ClientID]bool),
-			content: "",
+			lockDelay: DefaultLockDelay,
+			capacity: capacity,
+		}
+		state, err := app.store.GetLock(string(path))
+		if err == nil {
+			lock.generation = state.Generation
+		}
+		err = lock.persist()
+		if err != nil {
+			return err
 		}
 		app.locks[path] = lock
 		sess.locks[path] = lock
 	}
 
+	sess.opened[path] = true
+	return nil
+}
+
+// Create a directory if it does not exist. Its parent directory must exist.
+func (sess *Session) CreateDirectory(path api.FilePath) error {
+	return app.store.CreateDir(string(path))
+}
+
+// Delete a directory. Only empty directories can be deleted.
+func (sess *Session) DeleteDirectory(path api.FilePath) error {
+	return app.store.DeleteDir(string(path))
+}
+
+// Delete a file, or a directory and everything below it. Unless force is
+// set, fails if any lock in the subtree is held.
+func (sess *Session) DeleteRecursive(path api.FilePath, force bool) error {
+	done := invalidateSubtree(sess, path)
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	files, err := app.store.DeleteRecursive(string(path), force)
+	if err != nil {
+		return err
+	}
+	for _, key := range files {
+		forgetLock(lookupLock(api.FilePath(key)))
+	}
+	app.logger.Printf("Client %s deleted %s and %d files below it", sess.clientID, path, len(files))
+	return nil
+}
+
+// Move a file, or a directory and everything below it, to newPath. Unless
+// force is set, fails if any lock in the subtree is held.
+func (sess *Session) Rename(path api.FilePath, newPath api.FilePath, force bool) error {
+	done := invalidateSubtree(sess, path)
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	files, err := app.store.Rename(string(path), string(newPath), force)
+	if err != nil {
+		return err
+	}
+	for _, key := range files {
+		oldPath := api.FilePath(key)
+		movedPath := newPath + oldPath[len(path):]
+
+		// Sessions that had the file open still do under its new name,
+		// though their handles name the old path: they must open the file
+		// again to use it.
+		var openers []*Session
+		for _, s := range allSessions() {
+			if s.opened[oldPath] {
+				openers = append(openers, s)
+			}
+		}
+		forgetLock(lookupLock(oldPath))
+		for _, s := range openers {
+			s.opened[movedPath] = true
+		}
+	}
+	app.logger.Printf("Client %s moved %s to %s", sess.clientID, path, newPath)
+	return nil
+}
+
+// List the children of a directory.
+func (sess *Session) ListDirectory(path api.FilePath) ([]api.DirEntry, error) {
+	return app.store.ListDir(string(path))
+}
+
+// Find the files and directories matching a path prefix or glob.
+func (sess *Session) Find(pattern string) ([]api.FindEntry, error) {
+	return app.store.Find(pattern)
+}
+
+// Get the quota usage of a directory and of the session.
+func (sess *Session) GetQuotaUsage(path api.FilePath) (api.QuotaUsage, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	usage, err := app.store.Usage(string(path))
+	if err != nil {
+		return usage, err
+	}
+	usage.OpenLocks = len(sess.opened)
+	usage.MaxOpenLocks = app.maxLocksPerSession
+	return usage, nil
+}
+
+// Get the metadata of a file or directory.
+func (sess *Session) Stat(path api.FilePath) (api.NodeStat, error) {
+	return app.store.Stat(string(path))
+}
+
+// Mark a file as mandatory, so that reading it requires holding its lock,
+// or clear the mark.
+func (sess *Session) SetMandatory(path api.FilePath, mandatory bool) error {
+	if !app.store.Exists(string(path)) || app.store.IsDir(string(path)) {
+		return errors.New(fmt.Sprintf("File at %s does not exist", path))
+	}
+
+	// Mandatory files are not cached: reading them needs the lock.
+	done := invalidateFile(sess, path)
+	defer done()
+
+	return app.store.SetMandatory(string(path), mandatory)
+}
+
+// Get the ACL names of a file or directory.
+func (sess *Session) GetACL(path api.FilePath) (api.ACL, error) {
+	return app.store.GetACL(string(path))
+}
+
+// Set the ACL names of a file or directory.
+func (sess *Session) SetACL(path api.FilePath, acl api.ACL) error {
+	err := app.store.SetACL(string(path), acl)
+	if err == nil {
+		app.logger.Printf("Client %s set ACLs of %s", sess.clientID, path)
+	}
+	return err
+}
+
+// Set the lock-delay of a lock held by the session.
+func (sess *Session) SetLockDelay(path api.FilePath, lockDelay time.Duration) error {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if lockDelay < 0 || lockDelay > MaxLockDelay {
+		return errors.New(fmt.Sprintf("Lock-delay must be between 0 and %s", MaxLockDelay.String()))
+	}
+
+	lock := lookupLock(path)
+	if !lock.owners[sess.clientID] {
+		return errors.New(fmt.Sprintf("Client %s does not own lock at path %s", sess.clientID, path))
+	}
+
+	lock.lockDelay = lockDelay
+	return lock.persist()
+}
+
+// Set the policy used to schedule SHARED and EXCLUSIVE requests on the lock.
+func (sess *Session) SetLockPolicy(path api.FilePath, policy api.LockPolicy) error {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	if policy != api.WRITER_PREFERRING && policy != api.READER_PREFERRING && policy != api.STRICT_FIFO {
+		return errors.New(fmt.Sprintf("Invalid lock policy %d", policy))
+	}
+
+	// Check if lock exists in persistent store
+	_, err := app.store.Get(string(path))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Lock at %s has not been opened", path))
+	}
+
+	lock := lookupLock(path)
+	lock.policy = policy
+	err = lock.persist()
+	if err != nil {
+		return err
+	}
+
+	// Waiters may be grantable under the new policy.
+	lock.grantWaiters()
 	return nil
 }
 
 // Delete the lock. Lock must be held in exclusive mode before calling DeleteLock.
 func (sess *Session) DeleteLock(path api.FilePath) error {
+	// Check before invalidating, so that a doomed delete does not hold up
+	// the readers of the file.
+	app.lockMu.Lock()
+	_, err := sess.checkDeleteLock(path)
+	app.lockMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	done := invalidateFile(sess, path)
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// The lock may have changed hands while we waited.
+	lock, err := sess.checkDeleteLock(path)
+	if err != nil {
+		return err
+	}
+	return deleteLock(lock)
+}
+
+// Check that the session may delete the lock: it holds it in exclusive mode,
+// or is the only holder of a semaphore. Caller must hold app.lockMu.
+func (sess *Session) checkDeleteLock(path api.FilePath) (*Lock, error) {
 	// If we are not holding the lock, we cannot delete it.
-	lock, exists := sess.locks[path]
+	_, exists := sess.locks[path]
 	if !exists {
-		return errors.New(fmt.Sprintf("Client does not hold the lock at path %s", path))
+		return nil, errors.New(fmt.Sprintf("Client does not hold the lock at path %s", path))
 	}
+	lock := lookupLock(path)
 
-	// Check if we are holding the lock in exclusive mode
-	if lock.mode != api.EXCLUSIVE {
-		return errors.New(fmt.Sprintf("Client does not hold the lock at path %s in exclusive mode", path))
+	// Check if we are holding the lock in exclusive mode.
+	// A semaphore can be deleted by its only holder.
+	soleSemaphoreHolder := lock.mode == api.SEMAPHORE && len(lock.owners) == 1 && lock.owners[sess.clientID]
+	if lock.mode != api.EXCLUSIVE && !soleSemaphoreHolder {
+		return nil, errors.New(fmt.Sprintf("Client does not hold the lock at path %s in exclusive mode", path))
 	}
 
 	// Check that the lock actually exists in the store.
 	_, err := app.store.Get(string(path))
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("Lock at %s does not exist in persistent store", path))
+		return nil, errors.New(fmt.Sprintf("Lock at %s does not exist in persistent store", path))
 	}
+	return lock, nil
+}
+
+// Delete a lock and its file, dropping it from the sessions that hold or
+// opened it. Caller must hold app.lockMu.
+func deleteLock(lock *Lock) error {
+	forgetLock(lock)
 
+	// Delete the lock from the store.
+	return app.store.Delete(string(lock.path))
+}
+
+// Drop the in-memory state of a lock whose file is being deleted.
+// Caller must hold app.lockMu.
+func forgetLock(lock *Lock) {
 	// Delete the lock from Session metadata.
-	delete(sess.locks, path)
+	for _, s := range allSessions() {
+		delete(s.locks, lock.path)
+		delete(s.opened, lock.path)
+	}
 
 	// Delete the lock from in-memory struct of locks
-	delete(app.locks, path)
+	delete(app.locks, lock.path)
 
-	// Delete the lock from the store.
-	err = app.store.Delete(string(path))
-	return err
+	// Wake up anyone waiting on the lock: it will never be granted.
+	lock.failWaiters(errors.New(fmt.Sprintf("Lock at %s was deleted", lock.path)))
+
+	// Clients caching the file must not keep reading it.
+	dropCaches(lock.path)
 }
 
 // Try to acquire the lock, returning either success (true) or failure (false).
 func (sess *Session) TryAcquireLock (path api.FilePath, mode api.LockMode) (bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// Don't jump ahead of waiters that the lock's policy says go first.
+	lock, exists := app.locks[path]
+	if exists && lock.mustQueue(mode) {
+		app.logger.Printf("Failed to acquire lock %s: waiters are queued ahead", path)
+		queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+		return false, nil
+	}
+
+	isSuccessful, err := sess.tryAcquireLock(path, mode)
+	if err == nil && !isSuccessful {
+		queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+	}
+	return isSuccessful, err
+}
+
+// Acquire the lock, blocking until it is granted or until the timeout expires.
+// Waiters are queued on the lock in FIFO order and are woken up by
+// ReleaseLock, DeleteLock or TerminateSession instead of polling.
+func (sess *Session) AcquireLock (path api.FilePath, mode api.LockMode, timeout time.Duration) (bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
 	// Validate mode of the lock.
-	if mode != api.EXCLUSIVE && mode != api.SHARED {
+	if mode != api.EXCLUSIVE && mode != api.SHARED && mode != api.SEMAPHORE {
 		return false, errors.New(fmt.Sprintf("Invalid mode."))
 	}
 
-	// Do we already own the lock? Fail with error
-	/*_, owned := app.locks[path]
-	if owned {
-		return false, errors.New(fmt.Sprintf("We already own the lock at %s", path))
-	}*/
+	// If the lock's policy lets us go ahead of the waiters, try to grab
+	// the lock right away.
+	lock, exists := app.locks[path]
+	if !exists || !lock.mustQueue(mode) {
+		isSuccessful, err := sess.tryAcquireLock(path, mode)
+		if err != nil || isSuccessful {
+			return isSuccessful, err
+		}
+		queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+		if timeout <= 0 {
+			return false, nil
+		}
+		lock = app.locks[path]
+	} else {
+		queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+		if timeout <= 0 {
+			return false, nil
+		}
+	}
+
+	// Join the back of the waiter queue.
+	// The lock's policy decides which waiters are granted the lock first.
+	waiter := &lockWaiter{
+		sess: sess,
+		mode: mode,
+		ready: make(chan struct{}),
+	}
+	lock.waiters = append(lock.waiters, waiter)
+
+	return sess.waitForLock(lock, waiter, timeout)
+}
+
+// Block until the queued waiter is granted the lock, the session ends or the
+// timeout expires. Caller must hold app.lockMu, which is released while
+// waiting and held again on return.
+func (sess *Session) waitForLock (lock *Lock, waiter *lockWaiter, timeout time.Duration) (bool, error) {
+	app.lockMu.Unlock()
+
+	select {
+	case <-waiter.ready:
+	case <-sess.terminatedChan:
+	case <-time.After(timeout):
+	}
+
+	app.lockMu.Lock()
+
+	// We may have been granted the lock while reacquiring the mutex.
+	select {
+	case <-waiter.ready:
+		return waiter.err == nil, waiter.err
+	default:
+	}
+
+	// Leave the queue. Waiters that were stuck behind us may now be grantable.
+	lock.removeWaiter(waiter)
+	lock.grantWaiters()
+
+	if sess.terminated {
+		return false, errors.New(fmt.Sprintf("Session with client %s terminated", sess.clientID))
+	}
+	app.logger.Printf("Timed out waiting for lock %s for client %s", lock.path, sess.clientID)
+	return false, nil
+}
 
+// Upgrade a lock held in SHARED mode to EXCLUSIVE mode.
+// If the session is the only holder, the upgrade succeeds right away.
+// Otherwise the session keeps its shared lock and waits, ahead of other
+// EXCLUSIVE waiters, until the other holders release the lock or the timeout
+// expires.
+// Only one upgrade may be pending on a lock at a time, since two sessions
+// waiting for each other to release would deadlock.
+func (sess *Session) UpgradeLock (path api.FilePath, timeout time.Duration) (bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	isSuccessful, err := sess.tryUpgradeLock(path)
+	if err != nil || isSuccessful {
+		return isSuccessful, err
+	}
+	queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+	if timeout <= 0 {
+		return false, nil
+	}
+
+	lock := lookupLock(path)
+	for _, w := range lock.waiters {
+		if w.upgrade {
+			return false, errors.New(fmt.Sprintf("Another upgrade is already pending on lock %s", path))
+		}
+	}
+
+	// Join the front of the waiter queue: we already hold the lock, so
+	// nobody behind us can be granted it before we are.
+	waiter := &lockWaiter{
+		sess: sess,
+		mode: api.EXCLUSIVE,
+		upgrade: true,
+		ready: make(chan struct{}),
+	}
+	lock.waiters = append([]*lockWaiter{waiter}, lock.waiters...)
+
+	return sess.waitForLock(lock, waiter, timeout)
+}
+
+// Try to upgrade the lock from SHARED to EXCLUSIVE mode.
+// Caller must hold app.lockMu.
+func (sess *Session) tryUpgradeLock (path api.FilePath) (bool, error) {
 	// Check if lock exists in persistent store
 	_, err := app.store.Get(string(path))
-
 	if err != nil {
 		return false, errors.New(fmt.Sprintf("Lock at %s has not been opened", path))
 	}
 
-	// Check if lock exists in in-mem struct
-	lock, exists := app.locks[path]
-	if !exists {
-		// Assume that some failure has occurred
-		// Lazily recover lock struct: add lock to in-memory struct of locks
-		// TODO: check if this is correct?
-		app.logger.Printf("Lock Doesn't Exist with Client ID", sess.clientID)
+	lock := lookupLock(path)
+	if !lock.owners[sess.clientID] || lock.mode != api.SHARED {
+		return false, errors.New(fmt.Sprintf("Client %s does not hold lock at path %s in SHARED mode", sess.clientID, path))
+	}
 
-		lock = &Lock{
-			path: path,
-			mode: api.FREE,
-			owners: make(map[api.ClientID]bool),
-			content: "",
+	// Other holders still share the lock.
+	if len(lock.owners) > 1 {
+		app.logger.Printf("Failed to upgrade lock %s: held by %d clients", path, len(lock.owners))
+		return false, nil
+	}
+
+	// An upgrade is an exclusive acquire, so it gets a new generation number.
+	lock.mode = api.EXCLUSIVE
+	lock.generation++
+	err = lock.persist()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Downgrade a lock held in EXCLUSIVE mode to SHARED mode. Waiters that want
+// the lock in SHARED mode can then share it with the session.
+func (sess *Session) DowngradeLock (path api.FilePath) error {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// Check if lock exists in persistent store
+	_, err := app.store.Get(string(path))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Lock at %s has not been opened", path))
+	}
+
+	lock := lookupLock(path)
+	if !lock.owners[sess.clientID] || lock.mode != api.EXCLUSIVE {
+		return errors.New(fmt.Sprintf("Client %s does not hold lock at path %s in EXCLUSIVE mode", sess.clientID, path))
+	}
+
+	lock.mode = api.SHARED
+	err = lock.persist()
+	if err != nil {
+		return err
+	}
+
+	lock.grantWaiters()
+	return nil
+}
+
+// Try to acquire the lock. Caller must hold app.lockMu, and tells the
+// holders about the conflict if it fails: waiters are retried on every
+// release, and must not raise the event again each time.
+func (sess *Session) tryAcquireLock (path api.FilePath, mode api.LockMode) (bool, error) {
+	lock, canAcquire, err := sess.checkAcquireLock(path, mode)
+	if err != nil || !canAcquire {
+		return false, err
+	}
+
+	// Update lock owners and mode
+	lock.grant(sess.clientID, mode)
+
+	// Replicate the new lock state.
+	err = lock.persist()
+	if err != nil {
+		return false, err
+	}
+
+	// Add lock to session lock struct
+	sess.locks[path] = lock
+	return true, nil
+}
+
+// Try to acquire all of the given locks, or none of them. The new state of
+// every lock is replicated in a single Raft log entry.
+func (sess *Session) TryAcquireLocks (paths []api.FilePath, modes []api.LockMode) (bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// Check that every lock can be acquired before touching any of them.
+	locks := make([]*Lock, len(paths))
+	for i, path := range paths {
+		for _, other := range paths[:i] {
+			if other == path {
+				return false, errors.New(fmt.Sprintf("Lock at %s requested more than once", path))
+			}
 		}
-		app.locks[path] = lock
-		sess.locks[path] = lock
+
+		lock, exists := app.locks[path]
+		if exists && lock.mustQueue(modes[i]) {
+			app.logger.Printf("Failed to acquire lock %s: waiters are queued ahead", path)
+			queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+			return false, nil
+		}
+
+		lock, canAcquire, err := sess.checkAcquireLock(path, modes[i])
+		if err != nil || !canAcquire {
+			if err == nil {
+				queueEvent(api.Event{Type: api.CONFLICTING_LOCK_REQUEST, Filepath: path})
+			}
+			return false, err
+		}
+		locks[i] = lock
+	}
+
+	// Grant all of the locks and replicate them together.
+	states := make(map[string]*store.LockState)
+	for i, lock := range locks {
+		lock.grant(sess.clientID, modes[i])
+		states[string(lock.path)] = lock.state()
+	}
+	err := app.store.SetLocks(states)
+	if err != nil {
+		app.logger.Printf("Failed to replicate locks: %s", err.Error())
+		for _, lock := range locks {
+			lock.reload()
+		}
+		return false, err
+	}
+
+	// Add locks to session lock struct
+	for _, lock := range locks {
+		sess.locks[lock.path] = lock
+	}
+	return true, nil
+}
+
+// Check whether the session could acquire the lock right now, without
+// changing any state. Caller must hold app.lockMu.
+func (sess *Session) checkAcquireLock (path api.FilePath, mode api.LockMode) (*Lock, bool, error) {
+	// Validate mode of the lock.
+	if mode != api.EXCLUSIVE && mode != api.SHARED && mode != api.SEMAPHORE {
+		return nil, false, errors.New(fmt.Sprintf("Invalid mode."))
+	}
+
+	// Check if lock exists in persistent store
+	_, err := app.store.Get(string(path))
+
+	if err != nil {
+		return nil, false, errors.New(fmt.Sprintf("Lock at %s has not been opened", path))
+	}
+
+	// Grab lock struct, rebuilding it from the lock table if necessary.
+	lock := lookupLock(path)
+
+	// Do we already own the lock? Fail with error: changing the mode of a
+	// held lock must go through UpgradeLock or DowngradeLock.
+	if lock.owners[sess.clientID] {
+		return lock, false, errors.New(fmt.Sprintf("Client %s already holds the lock at %s", sess.clientID, path))
+	}
+
+	// Semaphores can only be acquired in SEMAPHORE mode, and vice versa.
+	if (lock.capacity > 0) != (mode == api.SEMAPHORE) {
+		return lock, false, errors.New(fmt.Sprintf("Mode %d does not match the kind of lock at %s", mode, path))
+	}
+
+	// Fail if the previous holder's session ended recently.
+	if time.Now().Before(lock.delayedUntil) {
+		app.logger.Printf("Failed to acquire lock %s: lock-delay in effect until %s", path, lock.delayedUntil.String())
+		return lock, false, nil
 	}
 
 	// Check the mode of the lock
@@ -257,63 +1040,63 @@ func (sess *Session) TryAcquireLock (path api.FilePath, mode api.LockMode) (bool
 		if len(lock.owners) == 0 {
 			// Throw an error if there are no owners but lock.mode is api.EXCLUSIVE:
 			// this means ReleaseLock was not implemented correctly
-			return false, errors.New("Lock has EXCLUSIVE mode despite having no owners")
+			return lock, false, errors.New("Lock has EXCLUSIVE mode despite having no owners")
 		} else if len(lock.owners) > 1 {
-			return false, errors.New("Lock has EXCLUSIVE mode but has multiple owners")
+			return lock, false, errors.New("Lock has EXCLUSIVE mode but has multiple owners")
 		} else {
 			// Fail with no error
 			app.logger.Printf("Failed to acquire lock %s: already held in EXCLUSIVE mode", path)
-			return false, nil
+			return lock, false, nil
 		}
 	case api.SHARED:
 		// If our mode is api.SHARED, then succeed; else fail
 		if mode == api.EXCLUSIVE {
 			app.logger.Printf("Failed to acquire lock %s in EXCLUSIVE mode: already held in SHARED mode", path)
-			return false, nil
-		} else {  // mode == api.SHARED
-			// Update lock owners
-			lock.owners[sess.clientID] = true
-
-			// Add lock to session lock struct
-			sess.locks[path] = lock
-			app.locks[path] = lock
-			// Return success
-			//app.logger.Printf("Lock %s acquired successfully with mode SHARED", path)
-			return true, nil
+			return lock, false, nil
+		}
+		return lock, true, nil
+	case api.SEMAPHORE:
+		// Succeed if there is room for another holder
+		if len(lock.owners) >= lock.capacity {
+			app.logger.Printf("Failed to acquire semaphore %s: all %d slots taken", path, lock.capacity)
+			return lock, false, nil
 		}
+		return lock, true, nil
 	case api.FREE:
 		// If lock has owners, either TryAcquireLock or ReleaseLock was not implemented correctly
 		if len(lock.owners) > 0 {
-			return false, errors.New("Lock has FREE mode but is owned by 1 or more clients")
+			return lock, false, errors.New("Lock has FREE mode but is owned by 1 or more clients")
 		}
 
 		// Should succeed regardless of mode
-		// Update lock owners
-		lock.owners[sess.clientID] = true
+		return lock, true, nil
+	default:
+		return lock, false, errors.New(fmt.Sprintf("Lock at %s has undefined mode %d", path, lock.mode))
+	}
+}
 
-		// Update lock mode
+// Add the client to the owners of the lock in the given mode. Caller must
+// have checked that the lock can be acquired and must hold app.lockMu.
+func (lock *Lock) grant(clientID api.ClientID, mode api.LockMode) {
+	if lock.mode == api.FREE {
+		// Every acquire of a free lock gets a new generation number, so
+		// sequencers from an earlier hold never become valid again.
+		lock.generation++
 		lock.mode = mode
-
-		// Add lock to session lock struct
-		sess.locks[path] = lock
-
-		// Update Lock Mode in the global Map
-		app.locks[path] = lock
-
-		// Return success
-		//if mode == api.SHARED {
-		//	app.logger.Printf("Lock %s acquired successfully with mode SHARED", path)
-		//} else {
-		//	app.logger.Printf("Lock %s acquired successfully with mode EXCLUSIVE", path)
-		//}
-		return true, nil
-	default:
-		return false, errors.New(fmt.Sprintf("Lock at %s has undefined mode %d", path, lock.mode))
 	}
+	lock.owners[clientID] = true
 }
 
 // Release the lock.
 func (sess *Session) ReleaseLock (path api.FilePath) (error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	return sess.releaseLock(path)
+}
+
+// Release the lock and hand it to any waiters. Caller must hold app.lockMu.
+func (sess *Session) releaseLock (path api.FilePath) (error) {
 	// Check if lock exists in persistent store
 	_, err := app.store.Get(string(path))
 
@@ -321,108 +1104,448 @@ func (sess *Session) ReleaseLock (path api.FilePath) (error) {
 		return errors.New(fmt.Sprintf("Client with id %s: Lock at %s does not exist in persistent store", path, sess.clientID))
 	}
 
-	// Grab lock struct from session locks map.
-	lock, present := app.locks[path]
-
-	// If not in session locks map, throw an error
-	if !present || lock == nil {
-		return errors.New(fmt.Sprintf("Lock at %s does not exist in session locks map", path))
-	}
+	// Grab lock struct, rebuilding it from the lock table if necessary.
+	lock := lookupLock(path)
 
 	// Check that we are among the owners of the lock.
-	_, present = lock.owners[sess.clientID]
+	_, present := lock.owners[sess.clientID]
 	if !present || !lock.owners[sess.clientID] {
-		return errors.New(fmt.Sprintf("Client %d does not own lock at path %s", sess.clientID, path))
+		return errors.New(fmt.Sprintf("Client %s does not own lock at path %s", sess.clientID, path))
 	}
 
+	err = lock.release(sess.clientID)
+	if err != nil {
+		return err
+	}
+
+	// Delete lock from session locks map
+	delete(sess.locks, path)
+	return nil
+}
+
+// Remove the client from the owners of the lock, replicate the new lock
+// state and hand the lock to the next waiters in line.
+// Caller must hold app.lockMu.
+func (lock *Lock) release(clientID api.ClientID) error {
 	// Switch on lock mode.
 	switch lock.mode {
 	case api.FREE:
 		// Throw an error: this means TryAcquire was not implemented correctly
-		return errors.New(fmt.Sprint("Lock at %s has FREE mode: acquire not implemented correctly Client ID %s", path, sess.clientID))
+		return errors.New(fmt.Sprintf("Lock at %s has FREE mode: acquire not implemented correctly Client ID %s", lock.path, clientID))
 	case api.EXCLUSIVE:
 		// Delete from lock owners
-		delete(lock.owners, sess.clientID)
+		delete(lock.owners, clientID)
 
 		// Set lock mode
 		lock.mode = api.FREE
-
-		// Delete lock from session locks map
-		delete(sess.locks, path)
-		app.locks[path] = lock
-		log.Printf("Release lock at %s\n", path)
-		// Return without error
-		return nil
-	case api.SHARED:
+	case api.SHARED, api.SEMAPHORE:
 		// Delete from lock owners
-		delete(lock.owners, sess.clientID)
+		delete(lock.owners, clientID)
 
 		// Set lock mode if no more owners
 		if len(lock.owners) == 0 {
 			lock.mode = api.FREE
 		}
+	default:
+		return errors.New(fmt.Sprintf("Lock at %s has undefined mode %d", lock.path, lock.mode))
+	}
 
-		// Delete lock from session locks map
-		delete(sess.locks, path)
-		app.locks[path] = lock
+	// Replicate the new lock state.
+	err := lock.persist()
+	if err != nil {
+		return err
+	}
+	log.Printf("Release lock at %s\n", lock.path)
 
-		// Return without error
-		return nil
-	default:
-		return errors.New(fmt.Sprintf("Lock at %s has undefined mode %d", path, lock.mode))
+	// Hand the lock to the next waiters in line.
+	lock.grantWaiters()
+
+	// Return without error
+	return nil
+}
+
+// Get a sequencer for a lock held by the session.
+func (sess *Session) GetSequencer (path api.FilePath) (api.Sequencer, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	lock := lookupLock(path)
+	if !lock.owners[sess.clientID] {
+		return api.Sequencer{}, errors.New(fmt.Sprintf("Client %s does not own lock at path %s", sess.clientID, path))
+	}
+
+	return api.Sequencer{
+		LockName: path,
+		Mode: lock.mode,
+		Generation: lock.generation,
+		Holder: sess.clientID,
+	}, nil
+}
+
+// Check that the lock described by the sequencer is still held in the same
+// mode by the client it was issued to, and has been neither free nor
+// upgraded since the sequencer was issued.
+func (sess *Session) CheckSequencer (seq api.Sequencer) (bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// Check if lock exists in persistent store
+	_, err := app.store.Get(string(seq.LockName))
+	if err != nil {
+		return false, nil
+	}
+
+	lock := lookupLock(seq.LockName)
+	if lock.mode == api.FREE || lock.mode != seq.Mode || !lock.owners[seq.Holder] {
+		return false, nil
+	}
+	return lock.generation == seq.Generation, nil
+}
+
+// Look up a lock in the in-memory struct of locks. If it is not there (e.g.
+// because this node just became leader), rebuild it from the replicated lock
+// table. Caller must hold app.lockMu.
+func lookupLock(path api.FilePath) *Lock {
+	lock, exists := app.locks[path]
+	if exists && lock != nil {
+		return lock
+	}
+
+	lock = &Lock{
+		path: path,
+	}
+	lock.reload()
+	app.locks[path] = lock
+	return lock
+}
+
+// Returns the state of the lock that is replicated through Raft.
+func (lock *Lock) state() *store.LockState {
+	owners := make(map[api.ClientID]bool)
+	for owner, held := range lock.owners {
+		owners[owner] = held
+	}
+	return &store.LockState{
+		Mode: lock.mode,
+		Owners: owners,
+		Generation: lock.generation,
+		LockDelay: lock.lockDelay,
+		Policy: lock.policy,
+		Capacity: lock.capacity,
+		DelayedUntil: lock.delayedUntil,
+	}
+}
+
+// Replicate the state of the lock through Raft. If that fails, roll the
+// in-memory lock back to the last replicated state.
+// Caller must hold app.lockMu.
+func (lock *Lock) persist() error {
+	err := app.store.SetLock(string(lock.path), lock.state())
+	if err != nil {
+		app.logger.Printf("Failed to replicate lock %s: %s", lock.path, err.Error())
+		lock.reload()
+	}
+	return err
+}
+
+// Load the state of the lock from the replicated lock table.
+func (lock *Lock) reload() {
+	state, err := app.store.GetLock(string(lock.path))
+	if err != nil {
+		// Lock was never replicated: it is free.
+		lock.mode = api.FREE
+		lock.owners = make(map[api.ClientID]bool)
+		lock.lockDelay = DefaultLockDelay
+		lock.policy = api.WRITER_PREFERRING
+		lock.capacity = 0
+		lock.delayedUntil = time.Time{}
+		return
+	}
+	lock.mode = state.Mode
+	lock.owners = state.Owners
+	lock.generation = state.Generation
+	lock.lockDelay = state.LockDelay
+	lock.policy = state.Policy
+	lock.capacity = state.Capacity
+
+	// A lock-delay started by a previous leader still holds off acquires,
+	// so waiters must be woken up when it ends.
+	delayStarted := !lock.delayedUntil.Equal(state.DelayedUntil)
+	lock.delayedUntil = state.DelayedUntil
+	if delayStarted && time.Now().Before(lock.delayedUntil) {
+		lock.wakeAfterDelay()
+	}
+}
+
+// Grant the lock to queued waiters in the order given by the lock's policy,
+// stopping at the first waiter whose request cannot be satisfied yet.
+// Caller must hold app.lockMu.
+func (lock *Lock) grantWaiters() {
+	for _, waiter := range lock.grantOrder() {
+		// Skip waiters whose session ended while they were queued.
+		if waiter.sess.terminated {
+			lock.removeWaiter(waiter)
+			continue
+		}
+
+		var isSuccessful bool
+		var err error
+		if waiter.upgrade {
+			isSuccessful, err = waiter.sess.tryUpgradeLock(lock.path)
+		} else {
+			isSuccessful, err = waiter.sess.tryAcquireLock(lock.path, waiter.mode)
+		}
+		if err == nil && !isSuccessful {
+			return
+		}
+
+		lock.removeWaiter(waiter)
+		waiter.err = err
+		close(waiter.ready)
+	}
+}
+
+// Returns the queued waiters in the order in which they should be granted
+// the lock. Caller must hold app.lockMu.
+func (lock *Lock) grantOrder() []*lockWaiter {
+	if lock.policy == api.STRICT_FIFO {
+		return append([]*lockWaiter{}, lock.waiters...)
+	}
+
+	// Serve the preferred mode first, keeping FIFO order within each mode.
+	// A pending upgrade counts as an EXCLUSIVE waiter.
+	preferred := api.EXCLUSIVE
+	if lock.policy == api.READER_PREFERRING {
+		preferred = api.SHARED
+	}
+	var first, second []*lockWaiter
+	for _, waiter := range lock.waiters {
+		if waiter.mode == preferred {
+			first = append(first, waiter)
+		} else {
+			second = append(second, waiter)
+		}
+	}
+	return append(first, second...)
+}
+
+// Should a new request in the given mode queue up behind the current waiters
+// rather than be granted right away? Caller must hold app.lockMu.
+func (lock *Lock) mustQueue(mode api.LockMode) bool {
+	switch lock.policy {
+	case api.STRICT_FIFO:
+		return len(lock.waiters) > 0
+	case api.READER_PREFERRING:
+		// New requests may barge ahead of waiters.
+		return false
+	default:  // api.WRITER_PREFERRING
+		// Once a writer is queued, new requests wait behind it.
+		for _, waiter := range lock.waiters {
+			if waiter.mode == api.EXCLUSIVE {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Wake up all waiters on the lock with the given error.
+// Caller must hold app.lockMu.
+func (lock *Lock) failWaiters(err error) {
+	for _, waiter := range lock.waiters {
+		waiter.err = err
+		close(waiter.ready)
+	}
+	lock.waiters = nil
+}
+
+// Start the lock-delay after a non-voluntary release. Waiters are woken up
+// again once the delay is over. Caller must hold app.lockMu.
+func (lock *Lock) startLockDelay() {
+	if lock.lockDelay <= 0 {
+		return
+	}
+	lock.delayedUntil = time.Now().Add(lock.lockDelay)
+	lock.wakeAfterDelay()
+}
+
+// Wake up waiters once the lock-delay is over. Caller must hold app.lockMu.
+func (lock *Lock) wakeAfterDelay() {
+	time.AfterFunc(time.Until(lock.delayedUntil), func() {
+		app.lockMu.Lock()
+		defer app.lockMu.Unlock()
+		lock.grantWaiters()
+	})
+}
+
+// Remove a waiter from the lock's queue. Caller must hold app.lockMu.
+func (lock *Lock) removeWaiter(waiter *lockWaiter) {
+	for i, w := range lock.waiters {
+		if w == waiter {
+			lock.waiters = append(lock.waiters[:i], lock.waiters[i+1:]...)
+			return
+		}
 	}
 }
 
-// Read the Content from a lockfile
-func (sess *Session) ReadContent (path api.FilePath) (string,error) {
+// Read the Content from a lockfile. As in Chubby, locks are advisory: the
+// caller only needs to hold the lock if the file is marked mandatory.
+// Also returns whether the client may cache the content: mandatory files are
+// never cached, since the client may lose the lock.
+func (sess *Session) ReadContent (path api.FilePath) ([]byte, bool, error) {
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// Register as a cacher before reading, so that a write racing with
+	// this read invalidates what we return.
+	cacheable := !app.store.IsMandatory(string(path)) && sess.cacheNode(path)
+
 	// Check if file exists in persistent store
 	content, err := app.store.Get(string(path))
 
 	if err != nil {
-		return "",errors.New(fmt.Sprintf("Client with id %s: File at %s does not exist in persistent store", path, sess.clientID))
+		return nil, false, errors.New(fmt.Sprintf("Client with id %s: File at %s does not exist in persistent store", path, sess.clientID))
 	}
 
-	// Grab lock struct from session locks map.
-	lock, present := app.locks[path]
-
-	// If not in session locks map, throw an error
-	if !present || lock == nil {
-		return "",errors.New(fmt.Sprintf("Lock at %s does not exist in session locks map", path))
+	if !app.store.IsMandatory(string(path)) {
+		return content, cacheable, nil
 	}
 
+	// Grab lock struct, rebuilding it from the lock table if necessary.
+	lock := lookupLock(path)
+
 	// Check that we are among the owners of the lock.
-	_, present = lock.owners[sess.clientID]
+	_, present := lock.owners[sess.clientID]
 	if !present || !lock.owners[sess.clientID] {
-		return "",errors.New(fmt.Sprintf("Client %d does not own lock at path %s", sess.clientID, path))
+		return nil, false, errors.New(fmt.Sprintf("Client %s does not own lock at path %s", sess.clientID, path))
 	}
 
-	return content, nil
+	return content, false, nil
 }
 
-// Write the Content to a lockfile
-func (sess *Session) WriteContent (path api.FilePath, content string) (error) {
+// Apply ops atomically if all the guards hold. Returns false if a guard did
+// not hold, in which case nothing was applied.
+func (sess *Session) Txn(guards []api.TxnGuard, ops []api.TxnOp) (bool, error) {
+	written := make(map[api.FilePath]bool)
+	for _, op := range ops {
+		written[op.Filepath] = true
+	}
+	done := invalidateCaches(sess, func(p api.FilePath) bool {
+		return written[p]
+	})
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	err := app.store.Txn(guards, ops, sess.clientID)
+	if _, failed := err.(*store.GuardFailedError); failed {
+		app.logger.Printf("Transaction of client %s not applied: %s", sess.clientID, err.Error())
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The store already dropped the lock state of deleted files.
+	for _, op := range ops {
+		if op.Type == api.TXN_DELETE {
+			forgetLock(lookupLock(op.Filepath))
+		}
+	}
+	return true, nil
+}
+
+// Check that the session may write the file: it exists and the session
+// holds its lock. Caller must hold app.lockMu.
+func (sess *Session) checkWrite(path api.FilePath) error {
 	// Check if file exists in persistent store
 	_, err := app.store.Get(string(path))
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("Client with id %s: File at %s does not exist in persistent store", path, sess.clientID))
+		return errors.New(fmt.Sprintf("Client with id %s: File at %s does not exist in persistent store", sess.clientID, path))
+	}
+
+	// Grab lock struct, rebuilding it from the lock table if necessary.
+	lock := lookupLock(path)
+
+	// Check that we are among the owners of the lock.
+	if !lock.owners[sess.clientID] {
+		return errors.New(fmt.Sprintf("Client %s does not own lock at path %s", sess.clientID, path))
+	}
+	return nil
+}
+
+// Run the checks of a write before invalidating caches, so that a write
+// bound to fail does not hold up the readers of the file.
+func (sess *Session) checkWriteBeforeInvalidate(path api.FilePath, content []byte) error {
+	err := app.store.CheckSize(string(path), content)
+	if err != nil {
+		return err
 	}
 
-	// Grab lock struct from session locks map.
-	lock, present := app.locks[path]
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+	return sess.checkWrite(path)
+}
 
-	// If not in session locks map, throw an error
-	if !present || lock == nil {
-		return errors.New(fmt.Sprintf("Lock at %s does not exist in session locks map", path))
+// Write the Content to a lockfile, but only if its content generation still
+// equals expectedGeneration. Returns false if some other write got there
+// first, along with the new content generation on success.
+func (sess *Session) CompareAndSetContent (path api.FilePath, content []byte, expectedGeneration uint64) (bool, uint64, error) {
+	err := sess.checkWriteBeforeInvalidate(path, content)
+	if err != nil {
+		return false, 0, err
 	}
 
-	// Check that we are among the owners of the lock.
-	_, present = lock.owners[sess.clientID]
-	if !present || !lock.owners[sess.clientID] {
-		return errors.New(fmt.Sprintf("Client %d does not own lock at path %s", sess.clientID, path))
+	done := invalidateFile(sess, path)
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// The lock may have changed hands while we waited.
+	err = sess.checkWrite(path)
+	if err != nil {
+		return false, 0, err
+	}
+
+	generation, err := app.store.CompareAndSet(string(path), content, expectedGeneration)
+	if _, mismatch := err.(*store.GenerationMismatchError); mismatch {
+		app.logger.Printf("Compare-and-set on %s failed: %s", path, err.Error())
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, generation, nil
+}
+
+// Write the Content to a lockfile
+func (sess *Session) WriteContent (path api.FilePath, content []byte) (error) {
+	err := sess.checkWriteBeforeInvalidate(path, content)
+	if err != nil {
+		return err
+	}
+
+	// Cached copies must be gone before the write commits.
+	done := invalidateFile(sess, path)
+	defer done()
+
+	app.lockMu.Lock()
+	defer app.lockMu.Unlock()
+
+	// The lock may have changed hands while we waited.
+	err = sess.checkWrite(path)
+	if err != nil {
+		return err
 	}
 
 	err = app.store.Set(string(path), content)
+	switch err.(type) {
+	case *store.FileTooLargeError, *store.QuotaExceededError:
+		return err
+	}
 	if err != nil {
 		return errors.New(fmt.Sprintf("Write Error"))
 	}
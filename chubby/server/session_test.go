@@ -0,0 +1,458 @@
+package server
+
+import (
+	"cos518project/chubby/api"
+	"testing"
+	"time"
+)
+
+func TestSequencerSharedHolders(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		mode     api.LockMode
+	}{
+		{name: "shared", mode: api.SHARED},
+		{name: "semaphore", capacity: 2, mode: api.SEMAPHORE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestApp(t)
+			a := newTestSession(t, "a")
+			b := newTestSession(t, "b")
+			openTestLock(t, "/ls/l", tt.capacity, a, b)
+			mustAcquire(t, a, "/ls/l", tt.mode)
+			mustAcquire(t, b, "/ls/l", tt.mode)
+			seqA, err := a.GetSequencer("/ls/l")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqB, err := b.GetSequencer("/ls/l")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Once a releases, only b's sequencer is valid.
+			mustRelease(t, a, "/ls/l")
+			if valid, _ := b.CheckSequencer(seqB); !valid {
+				t.Error("sequencer of a remaining holder is invalid")
+			}
+			if valid, _ := b.CheckSequencer(seqA); valid {
+				t.Error("sequencer of a released holder is valid")
+			}
+
+			// Nor does a's sequencer become valid again once the lock was
+			// free and a holds it again in the same mode.
+			mustRelease(t, b, "/ls/l")
+			mustAcquire(t, a, "/ls/l", tt.mode)
+			for _, seq := range []api.Sequencer{seqA, seqB} {
+				if valid, _ := a.CheckSequencer(seq); valid {
+					t.Errorf("sequencer %+v from before the lock was free is valid", seq)
+				}
+			}
+		})
+	}
+}
+
+func TestSequencerAfterForcedDelete(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	openTestLock(t, "/ls/l", 0, a)
+	mustAcquire(t, a, "/ls/l", api.SHARED)
+	seq, err := a.GetSequencer("/ls/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is deleted under a, then created and locked again.
+	if err := b.DeleteRecursive("/ls/l", true); err != nil {
+		t.Fatal(err)
+	}
+	openTestLock(t, "/ls/l", 0, a)
+	mustAcquire(t, a, "/ls/l", api.SHARED)
+	if valid, _ := a.CheckSequencer(seq); valid {
+		t.Error("sequencer from before the delete is valid")
+	}
+}
+
+func TestSequencerUpgrade(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	openTestLock(t, "/ls/l", 0, a)
+	mustAcquire(t, a, "/ls/l", api.SHARED)
+	shared, err := a.GetSequencer("/ls/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.UpgradeLock("/ls/l", 0); !ok || err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	exclusive, err := a.GetSequencer("/ls/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := a.CheckSequencer(shared); valid {
+		t.Error("shared sequencer is valid after the upgrade")
+	}
+	if valid, _ := a.CheckSequencer(exclusive); !valid {
+		t.Error("exclusive sequencer is invalid")
+	}
+}
+
+func TestAcquireLockFIFO(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	d := newTestSession(t, "d")
+	openTestLock(t, "/ls/l", 0, a, b, c, d)
+	mustAcquire(t, a, "/ls/l", api.EXCLUSIVE)
+
+	doneB := startAcquire(t, b, "/ls/l", api.EXCLUSIVE, false)
+	doneC := startAcquire(t, c, "/ls/l", api.EXCLUSIVE, false)
+	doneD := startAcquire(t, d, "/ls/l", api.EXCLUSIVE, false)
+
+	// Each release hands the lock to the next waiter, in arrival order.
+	mustRelease(t, a, "/ls/l")
+	wantGranted(t, b, doneB)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "b")
+	mustRelease(t, b, "/ls/l")
+	wantGranted(t, c, doneC)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "c")
+	mustRelease(t, c, "/ls/l")
+	wantGranted(t, d, doneD)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "d")
+	if n := waiterCount("/ls/l"); n != 0 {
+		t.Errorf("got %d waiters left, want 0", n)
+	}
+}
+
+func TestAcquireLockTimeout(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	openTestLock(t, "/ls/l", 0, a, b)
+	mustAcquire(t, a, "/ls/l", api.EXCLUSIVE)
+
+	ok, err := b.AcquireLock("/ls/l", api.EXCLUSIVE, 50*time.Millisecond)
+	if ok || err != nil {
+		t.Fatalf("got %v, %v, want a timeout", ok, err)
+	}
+	if n := waiterCount("/ls/l"); n != 0 {
+		t.Errorf("timed out waiter still queued: %d waiters", n)
+	}
+
+	// Without a timeout, a busy lock fails right away.
+	if ok, err := b.AcquireLock("/ls/l", api.EXCLUSIVE, 0); ok || err != nil {
+		t.Errorf("got %v, %v, want failure", ok, err)
+	}
+}
+
+func TestAcquireLockSessionEnds(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	openTestLock(t, "/ls/l", 0, a, b, c)
+	mustAcquire(t, a, "/ls/l", api.EXCLUSIVE)
+	doneB := startAcquire(t, b, "/ls/l", api.EXCLUSIVE, false)
+	doneC := startAcquire(t, c, "/ls/l", api.EXCLUSIVE, false)
+
+	// A waiter whose session ends leaves the queue, and is skipped.
+	b.TerminateSession()
+	select {
+	case res := <-doneB:
+		if res.ok || res.err == nil {
+			t.Errorf("got %v, %v, want an error", res.ok, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter of an ended session still blocked")
+	}
+	mustRelease(t, a, "/ls/l")
+	wantGranted(t, c, doneC)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "c")
+}
+
+func TestUpgradeLockJumpsQueue(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	openTestLock(t, "/ls/l", 0, a, b, c)
+	mustAcquire(t, a, "/ls/l", api.SHARED)
+	mustAcquire(t, b, "/ls/l", api.SHARED)
+
+	// c queues first, but a already holds the lock and goes ahead of it.
+	doneC := startAcquire(t, c, "/ls/l", api.EXCLUSIVE, false)
+	doneA := startAcquire(t, a, "/ls/l", api.EXCLUSIVE, true)
+	wantHolders(t, "/ls/l", api.SHARED, "a", "b")
+
+	mustRelease(t, b, "/ls/l")
+	wantGranted(t, a, doneA)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "a")
+
+	mustRelease(t, a, "/ls/l")
+	wantGranted(t, c, doneC)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "c")
+}
+
+func TestUpgradeLock(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	openTestLock(t, "/ls/l", 0, a, b, c)
+
+	// Only a SHARED lock can be upgraded.
+	if _, err := a.UpgradeLock("/ls/l", 0); err == nil {
+		t.Error("upgraded a lock the session does not hold")
+	}
+
+	// The only holder upgrades right away.
+	mustAcquire(t, a, "/ls/l", api.SHARED)
+	if ok, err := a.UpgradeLock("/ls/l", 0); !ok || err != nil {
+		t.Fatalf("got %v, %v, want the upgrade", ok, err)
+	}
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "a")
+	if err := a.DowngradeLock("/ls/l"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With other holders, it fails without a timeout, and a second upgrade
+	// cannot wait behind a pending one.
+	mustAcquire(t, b, "/ls/l", api.SHARED)
+	mustAcquire(t, c, "/ls/l", api.SHARED)
+	if ok, err := a.UpgradeLock("/ls/l", 0); ok || err != nil {
+		t.Errorf("got %v, %v, want failure", ok, err)
+	}
+	doneA := startAcquire(t, a, "/ls/l", api.EXCLUSIVE, true)
+	if _, err := b.UpgradeLock("/ls/l", time.Minute); err == nil {
+		t.Error("second upgrade was queued")
+	}
+	mustRelease(t, b, "/ls/l")
+	mustRelease(t, c, "/ls/l")
+	wantGranted(t, a, doneA)
+	wantHolders(t, "/ls/l", api.EXCLUSIVE, "a")
+}
+
+func TestDowngradeLock(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	openTestLock(t, "/ls/l", 0, a, b)
+	mustAcquire(t, a, "/ls/l", api.EXCLUSIVE)
+	doneB := startAcquire(t, b, "/ls/l", api.SHARED, false)
+
+	// Readers waiting for the lock share it once it is downgraded.
+	if err := a.DowngradeLock("/ls/l"); err != nil {
+		t.Fatal(err)
+	}
+	wantGranted(t, b, doneB)
+	wantHolders(t, "/ls/l", api.SHARED, "a", "b")
+
+	if err := a.DowngradeLock("/ls/l"); err == nil {
+		t.Error("downgraded a SHARED lock")
+	}
+}
+
+func TestLockPolicyBarging(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy api.LockPolicy
+		want   bool  // Can a new reader go ahead of a queued writer?
+	}{
+		{name: "writer-preferring", policy: api.WRITER_PREFERRING, want: false},
+		{name: "reader-preferring", policy: api.READER_PREFERRING, want: true},
+		{name: "strict FIFO", policy: api.STRICT_FIFO, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestApp(t)
+			a := newTestSession(t, "a")
+			b := newTestSession(t, "b")
+			c := newTestSession(t, "c")
+			openTestLock(t, "/ls/l", 0, a, b, c)
+			if err := a.SetLockPolicy("/ls/l", tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			mustAcquire(t, a, "/ls/l", api.SHARED)
+			startAcquire(t, b, "/ls/l", api.EXCLUSIVE, false)
+
+			ok, err := c.TryAcquireLock("/ls/l", api.SHARED)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("got %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockPolicyGrantOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy api.LockPolicy
+		mode   api.LockMode
+		want   []api.ClientID  // Granted the lock once it is free.
+	}{
+		{name: "writer-preferring", policy: api.WRITER_PREFERRING, mode: api.EXCLUSIVE, want: []api.ClientID{"c"}},
+		{name: "reader-preferring", policy: api.READER_PREFERRING, mode: api.SHARED, want: []api.ClientID{"b", "d"}},
+		{name: "strict FIFO", policy: api.STRICT_FIFO, mode: api.SHARED, want: []api.ClientID{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestApp(t)
+			a := newTestSession(t, "a")
+			b := newTestSession(t, "b")
+			c := newTestSession(t, "c")
+			d := newTestSession(t, "d")
+			openTestLock(t, "/ls/l", 0, a, b, c, d)
+			if err := a.SetLockPolicy("/ls/l", tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			mustAcquire(t, a, "/ls/l", api.EXCLUSIVE)
+
+			// A reader, a writer and another reader queue up, in order.
+			done := map[api.ClientID]<-chan acquireResult{
+				"b": startAcquire(t, b, "/ls/l", api.SHARED, false),
+				"c": startAcquire(t, c, "/ls/l", api.EXCLUSIVE, false),
+				"d": startAcquire(t, d, "/ls/l", api.SHARED, false),
+			}
+
+			mustRelease(t, a, "/ls/l")
+			for _, clientID := range tt.want {
+				sess, _ := getSession(clientID)
+				wantGranted(t, sess, done[clientID])
+			}
+			wantHolders(t, "/ls/l", tt.mode, tt.want...)
+			if n := waiterCount("/ls/l"); n != 3 - len(tt.want) {
+				t.Errorf("got %d waiters, want %d", n, 3 - len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSemaphoreCapacity(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	openTestLock(t, "/ls/sem", 2, a, b, c)
+
+	// Up to capacity holders share the semaphore.
+	mustAcquire(t, a, "/ls/sem", api.SEMAPHORE)
+	mustAcquire(t, b, "/ls/sem", api.SEMAPHORE)
+	wantHolders(t, "/ls/sem", api.SEMAPHORE, "a", "b")
+	if ok, err := c.TryAcquireLock("/ls/sem", api.SEMAPHORE); ok || err != nil {
+		t.Errorf("got %v, %v, want the semaphore to be full", ok, err)
+	}
+
+	// A waiter takes the first slot freed.
+	doneC := startAcquire(t, c, "/ls/sem", api.SEMAPHORE, false)
+	mustRelease(t, a, "/ls/sem")
+	wantGranted(t, c, doneC)
+	wantHolders(t, "/ls/sem", api.SEMAPHORE, "b", "c")
+}
+
+func TestSemaphoreMode(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	openTestLock(t, "/ls/sem", 2, a)
+	openTestLock(t, "/ls/l", 0, a)
+
+	// Semaphores are only acquired in SEMAPHORE mode, and other locks never.
+	for _, mode := range []api.LockMode{api.SHARED, api.EXCLUSIVE} {
+		if _, err := a.TryAcquireLock("/ls/sem", mode); err == nil {
+			t.Errorf("acquired a semaphore in mode %d", mode)
+		}
+	}
+	if _, err := a.TryAcquireLock("/ls/l", api.SEMAPHORE); err == nil {
+		t.Error("acquired a lock in SEMAPHORE mode")
+	}
+
+	// An existing lock keeps its capacity.
+	if err := a.OpenLock("/ls/sem", 3, false); err == nil {
+		t.Error("opened a semaphore with another capacity")
+	}
+	if err := a.OpenLock("/ls/sem", 0, false); err != nil {
+		t.Errorf("could not open an existing semaphore: %s", err.Error())
+	}
+	if err := a.OpenLock("/ls/neg", -1, false); err == nil {
+		t.Error("opened a semaphore with a negative capacity")
+	}
+}
+
+func TestTryAcquireLocksAllOrNothing(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	b := newTestSession(t, "b")
+	c := newTestSession(t, "c")
+	openTestLock(t, "/ls/l1", 0, a, b, c)
+	openTestLock(t, "/ls/l2", 0, a, b)
+	paths := []api.FilePath{"/ls/l1", "/ls/l2"}
+	modes := []api.LockMode{api.SHARED, api.EXCLUSIVE}
+
+	// One busy lock and none is taken.
+	mustAcquire(t, b, "/ls/l2", api.EXCLUSIVE)
+	if ok, err := a.TryAcquireLocks(paths, modes); ok || err != nil {
+		t.Fatalf("got %v, %v, want failure", ok, err)
+	}
+	wantHolders(t, "/ls/l1", api.FREE)
+	wantHolders(t, "/ls/l2", api.EXCLUSIVE, "b")
+
+	// Nor while a writer is queued ahead on one of them, though a could
+	// share it.
+	mustAcquire(t, c, "/ls/l1", api.SHARED)
+	doneB := startAcquire(t, b, "/ls/l1", api.EXCLUSIVE, false)
+	mustRelease(t, b, "/ls/l2")
+	if ok, err := a.TryAcquireLocks(paths, modes); ok || err != nil {
+		t.Fatalf("got %v, %v, want failure", ok, err)
+	}
+	wantHolders(t, "/ls/l1", api.SHARED, "c")
+	wantHolders(t, "/ls/l2", api.FREE)
+
+	// Once both are free, both are taken, and replicated together.
+	mustRelease(t, c, "/ls/l1")
+	wantGranted(t, b, doneB)
+	mustRelease(t, b, "/ls/l1")
+	if ok, err := a.TryAcquireLocks(paths, modes); !ok || err != nil {
+		t.Fatalf("got %v, %v, want both locks", ok, err)
+	}
+	wantHolders(t, "/ls/l1", api.SHARED, "a")
+	wantHolders(t, "/ls/l2", api.EXCLUSIVE, "a")
+	for i, path := range paths {
+		state, err := app.store.GetLock(string(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Mode != modes[i] || !state.Owners["a"] {
+			t.Errorf("%s: got replicated state %+v", path, state)
+		}
+	}
+}
+
+func TestTryAcquireLocksInvalid(t *testing.T) {
+	newTestApp(t)
+	a := newTestSession(t, "a")
+	openTestLock(t, "/ls/l1", 0, a)
+
+	tests := []struct {
+		name  string
+		paths []api.FilePath
+		modes []api.LockMode
+	}{
+		{name: "same lock twice", paths: []api.FilePath{"/ls/l1", "/ls/l1"}, modes: []api.LockMode{api.SHARED, api.SHARED}},
+		{name: "lock not opened", paths: []api.FilePath{"/ls/l1", "/ls/none"}, modes: []api.LockMode{api.SHARED, api.SHARED}},
+		{name: "invalid mode", paths: []api.FilePath{"/ls/l1"}, modes: []api.LockMode{api.FREE}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok, err := a.TryAcquireLocks(tt.paths, tt.modes); ok || err == nil {
+				t.Errorf("got %v, %v, want an error", ok, err)
+			}
+			wantHolders(t, "/ls/l1", api.FREE)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Access control lists.
+//
+// As in Chubby, ACLs are themselves files: every node names an ACL file for
+// each permission, and the content of that file lists the clients that hold
+// the permission. Changes to the ACL names go through Raft like any other
+// write, and bump the ACL generation of the node.
+//
+// Locks are advisory, so ACLs alone decide who may read a file, unless the
+// file is marked mandatory: then readers must also hold its lock.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Allows every client when listed in an ACL file.
+const AnyClient = "*"
+
+// Returned when a client lacks the permission it needs on a node.
+type PermissionDeniedError struct {
+	Key			string
+	ClientID	api.ClientID
+	Permission	api.Permission
+}
+
+func (e *PermissionDeniedError) Error() string {
+	names := map[api.Permission]string{api.READ: "read", api.WRITE: "write", api.CHANGE_ACL: "change-ACL"}
+	return fmt.Sprintf("client %s does not have %s permission on %s", e.ClientID, names[e.Permission], e.Key)
+}
+
+// GetACL returns the ACL names of the given file or directory.
+func (s *Store) GetACL(key string) (api.ACL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.exists(key) {
+		return api.ACL{}, errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+	if m, exists := s.meta[key]; exists {
+		return m.ACL, nil
+	}
+	return api.ACL{}, nil
+}
+
+// SetACL sets the ACL names of the given file or directory. Children created
+// afterwards inherit the new names; existing children keep theirs.
+func (s *Store) SetACL(key string, acl api.ACL) error {
+	if key != RootDir {
+		if err := checkPath(key); err != nil {
+			return err
+		}
+	}
+
+	c := &command{
+		Op:  "setacl",
+		Key: key,
+		ACL: &acl,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// CheckPermission returns a *PermissionDeniedError unless the client has
+// perm on the given file or directory. A missing ACL file allows no one.
+func (s *Store) CheckPermission(key string, clientID api.ClientID, perm api.Permission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.exists(key) {
+		return errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+	m, exists := s.meta[key]
+	if !exists {
+		return nil
+	}
+
+	var aclFile api.FilePath
+	switch perm {
+	case api.READ:
+		aclFile = m.ACL.Read
+	case api.WRITE:
+		aclFile = m.ACL.Write
+	case api.CHANGE_ACL:
+		aclFile = m.ACL.ChangeACL
+	}
+	if aclFile == "" {
+		return nil
+	}
+
+	for _, line := range strings.Split(string(s.m[string(aclFile)]), "\n") {
+		name := strings.TrimSpace(line)
+		if name == AnyClient || name == string(clientID) {
+			return nil
+		}
+	}
+	return &PermissionDeniedError{Key: key, ClientID: clientID, Permission: perm}
+}
+
+// SetMandatory marks a file as mandatory, or clears the mark.
+func (s *Store) SetMandatory(key string, mandatory bool) error {
+	if err := checkPath(key); err != nil {
+		return err
+	}
+
+	c := &command{
+		Op:        "setmandatory",
+		Key:       key,
+		Mandatory: mandatory,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// IsMandatory returns whether key is a file marked mandatory.
+func (s *Store) IsMandatory(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, exists := s.meta[key]
+	return exists && m.Mandatory
+}
+
+// Exists returns whether key is a file or directory.
+func (s *Store) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exists(key)
+}
+
+// Caller must hold s.mu.
+func (s *Store) exists(key string) bool {
+	_, isFile := s.m[key]
+	return isFile || s.isDir(key)
+}
+
+func (f *fsm) applySetACL(key string, acl *api.ACL, now time.Time) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !(*Store)(f).exists(key) {
+		return errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+	m, exists := f.meta[key]
+	if !exists {
+		// The root directory has no metadata until its ACLs are first set.
+		m = (*Store)(f).createMeta(key, now)
+	}
+	m.ACL = *acl
+	m.ACLGeneration++
+	m.Modified = now
+	return nil
+}
+
+func (f *fsm) applySetMandatory(key string, mandatory bool, now time.Time) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, isFile := f.m[key]; !isFile {
+		return errors.New(fmt.Sprintf("file %s does not exist", key))
+	}
+	m, exists := f.meta[key]
+	if !exists {
+		m = (*Store)(f).createMeta(key, now)
+	}
+	m.Mandatory = mandatory
+	m.Modified = now
+	return nil
+}
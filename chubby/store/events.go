@@ -0,0 +1,47 @@
+// Change notifications for Chubby events.
+//
+// The FSM reports every change it applies through Store.Notify, on every
+// replica. Only the leader has sessions to deliver events to, so followers
+// simply drop them. Notify is called with s.mu held and must not call back
+// into the store.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+)
+
+// Record the change for watchers and report it. Caller must hold s.mu.
+func (s *Store) notify(event api.Event) {
+	s.record(event)
+	if s.Notify != nil {
+		s.Notify(event)
+	}
+}
+
+// Report that the content of a file changed. Caller must hold s.mu.
+func (s *Store) notifyModified(key string) {
+	s.notify(api.Event{Type: api.CONTENT_MODIFIED, Filepath: api.FilePath(key)})
+}
+
+// Report that a node was created. Caller must hold s.mu.
+func (s *Store) notifyAdded(key string) {
+	s.notify(api.Event{Type: api.CHILD_ADDED, Filepath: api.FilePath(parentDir(key)), Child: api.FilePath(key)})
+}
+
+// Report that a node was deleted. Caller must hold s.mu.
+func (s *Store) notifyRemoved(key string) {
+	s.notify(api.Event{Type: api.CHILD_REMOVED, Filepath: api.FilePath(parentDir(key)), Child: api.FilePath(key)})
+}
+
+// Report that a client acquired the lock, if state has an owner that the
+// current lock state does not. Caller must hold s.mu.
+func (s *Store) notifyAcquired(key string, state *LockState) {
+	old, exists := s.locks[key]
+	for owner := range state.Owners {
+		if !exists || !old.Owners[owner] {
+			s.notify(api.Event{Type: api.LOCK_ACQUIRED, Filepath: api.FilePath(key)})
+			return
+		}
+	}
+}
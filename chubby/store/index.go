@@ -0,0 +1,140 @@
+// Ordered index of the names of all files and directories.
+//
+// Store.m and Store.dirs are Go maps, which have no order. The index keeps
+// every name sorted so that the namespace can be scanned by prefix without
+// looking at every node.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Sorted names of all files and directories, without the root directory.
+type keyIndex struct {
+	keys []string
+	children map[string]int  // Number of children of each directory.
+}
+
+// Add key to the index if it is not there yet.
+func (x *keyIndex) insert(key string) {
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		return
+	}
+	x.keys = append(x.keys, "")
+	copy(x.keys[i+1:], x.keys[i:])
+	x.keys[i] = key
+
+	if x.children == nil {
+		x.children = make(map[string]int)
+	}
+	x.children[parentDir(key)]++
+}
+
+// Remove key from the index if it is there.
+func (x *keyIndex) remove(key string) {
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		x.keys = append(x.keys[:i], x.keys[i+1:]...)
+
+		parent := parentDir(key)
+		x.children[parent]--
+		if x.children[parent] == 0 {
+			delete(x.children, parent)
+		}
+	}
+}
+
+// Returns the names that start with prefix, in order. The result is a copy,
+// so the caller may change the index while going through it.
+func (x *keyIndex) withPrefix(prefix string) []string {
+	i := sort.SearchStrings(x.keys, prefix)
+	j := i
+	for j < len(x.keys) && strings.HasPrefix(x.keys[j], prefix) {
+		j++
+	}
+	return append([]string{}, x.keys[i:j]...)
+}
+
+// Returns the names directly below the directory dir, in order. The
+// subtrees of its child directories are skipped over, not scanned.
+func (x *keyIndex) childrenOf(dir string) []string {
+	prefix := dir + "/"
+	names := []string{}
+	i := sort.SearchStrings(x.keys, prefix)
+	for i < len(x.keys) && strings.HasPrefix(x.keys[i], prefix) {
+		k := x.keys[i]
+		if parentDir(k) == dir {
+			names = append(names, k)
+			i++
+			continue
+		}
+		// k is below a child directory. Everything below the child sorts
+		// before child + "0", since '0' comes right after '/'.
+		child := prefix + strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]
+		i = sort.SearchStrings(x.keys, child + "0")
+	}
+	return names
+}
+
+// Rebuild the index from the files and directories of the store.
+func (x *keyIndex) rebuild(values map[string][]byte, dirs map[string]bool) {
+	x.keys = make([]string, 0, len(values) + len(dirs))
+	for k := range values {
+		x.keys = append(x.keys, k)
+	}
+	for k := range dirs {
+		x.keys = append(x.keys, k)
+	}
+	sort.Strings(x.keys)
+
+	x.children = make(map[string]int)
+	for _, k := range x.keys {
+		x.children[parentDir(k)]++
+	}
+}
+
+// Find returns the files and directories matching pattern, sorted by path,
+// with their metadata. A pattern without wildcards matches every path that
+// starts with it; otherwise it is a glob as in path.Match, where '*' does
+// not match '/'.
+func (s *Store) Find(pattern string) ([]api.FindEntry, error) {
+	if !strings.HasPrefix(pattern, RootDir + "/") {
+		return nil, errors.New(fmt.Sprintf("invalid pattern %s: patterns start with %s/", pattern, RootDir))
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid pattern %s: %s", pattern, err.Error()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only names starting with the part before the first wildcard can match.
+	prefix := pattern
+	isGlob := false
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		prefix = pattern[:i]
+		isGlob = true
+	}
+
+	entries := []api.FindEntry{}
+	for _, k := range s.index.withPrefix(prefix) {
+		if isGlob {
+			if matched, _ := path.Match(pattern, k); !matched {
+				continue
+			}
+		}
+		stat, err := s.stat(k)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, api.FindEntry{Path: api.FilePath(k), Stat: stat})
+	}
+	return entries, nil
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{pattern: "/ls/a", want: []string{"/ls/a", "/ls/a/x", "/ls/a/y", "/ls/a/y/z", "/ls/ab"}},
+		{pattern: "/ls/a/", want: []string{"/ls/a/x", "/ls/a/y", "/ls/a/y/z"}},
+		{pattern: "/ls/a/*", want: []string{"/ls/a/x", "/ls/a/y"}},
+		{pattern: "/ls/a/*/*", want: []string{"/ls/a/y/z"}},
+		{pattern: "/ls/?b", want: []string{"/ls/ab"}},
+		{pattern: "/ls/[ab]", want: []string{"/ls/a", "/ls/b"}},
+		{pattern: "/ls/none", want: []string{}},
+		{pattern: "/ls/none*", want: []string{}},
+		{pattern: "/other", wantErr: true},
+		{pattern: "/ls/[", wantErr: true},
+	}
+
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/a"})
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/a/y"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/a/x"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/a/y/z"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/ab"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/b"})
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			entries, err := s.Find(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, string(e.Path))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAfterDeleteAndRename(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/g"})
+	s.mustCommit(t, &command{Op: "delete", Key: "/ls/d/g"})
+	s.mustCommit(t, &command{Op: "rename", Key: "/ls/d", NewKey: "/ls/e"})
+
+	entries, err := s.Find("/ls/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, string(e.Path))
+	}
+	if want := []string{"/ls/e", "/ls/e/f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestListDir(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d/sub"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/sub/deep"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/sub-file", Value: []byte("abc")})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/a"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d0"})
+
+	tests := []struct {
+		dir     string
+		want    []string
+		wantErr bool
+	}{
+		{dir: "/ls", want: []string{"d", "d0"}},
+		{dir: "/ls/d", want: []string{"a", "sub", "sub-file"}},
+		{dir: "/ls/d/sub", want: []string{"deep"}},
+		{dir: "/ls/d/a", wantErr: true},
+		{dir: "/ls/none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			entries, err := s.ListDir(tt.dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, tt.wantErr)
+			}
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, e.Name)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
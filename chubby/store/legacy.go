@@ -0,0 +1,93 @@
+// Decoding of the JSON log entries and snapshots written by the baseline
+// server, before commands and snapshots were gob-encoded, so that an
+// existing data directory can still be replayed.
+//
+// A gob stream is never valid JSON, so valid JSON marks the old format.
+
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// A command as the baseline server JSON-encoded it, with the file content as
+// a string. It only ever wrote "set" and "delete".
+type legacyCommand struct {
+	Op    string `json:"op,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// Decode a Raft log entry, in either format.
+func decodeCommand(data []byte, c *command) error {
+	if !json.Valid(data) {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(c)
+	}
+
+	var l legacyCommand
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	switch l.Op {
+	case "set":
+		// Old keys are lock names, not paths below RootDir.
+		*c = command{Op: "legacyset", Key: l.Key, Value: []byte(l.Value)}
+	case "delete":
+		*c = command{Op: "delete", Key: l.Key}
+	default:
+		return errors.New(fmt.Sprintf("unrecognized legacy command op: %s", l.Op))
+	}
+	return nil
+}
+
+// Decode a snapshot, in either format. The baseline server snapshotted its
+// key-value map and nothing else.
+func decodeState(rc io.Reader, o *fsmState) error {
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(o)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return errors.New(fmt.Sprintf("unrecognized legacy snapshot: %s", err.Error()))
+	}
+	if values == nil {
+		return errors.New("unrecognized legacy snapshot: null")
+	}
+	*o = fsmState{Values: make(map[string][]byte)}
+	for k, v := range values {
+		o.Values[k] = []byte(v)
+	}
+	return nil
+}
+
+// Apply a set written by the baseline server. Its key need not be a path
+// below RootDir, so the namespace checks of applySet are skipped, as they
+// are when restoring a baseline snapshot.
+func (f *fsm) applyLegacySet(key string, value []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := (*Store)(f)
+	_, exists := f.m[key]
+	s.setValue(key, value)
+	f.index.insert(key)
+	s.updateMeta(key, value, time.Time{})
+	if exists {
+		s.notifyModified(key)
+	} else {
+		s.notifyAdded(key)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRestoreLegacySnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		want     map[string]string  // nil if the snapshot must be rejected.
+	}{
+		{
+			name:     "baseline key-value map",
+			snapshot: `{"lock":"","Lock/Lock1":"holder"}`,
+			want:     map[string]string{"lock": "", "Lock/Lock1": "holder"},
+		},
+		{name: "empty map", snapshot: `{}`, want: map[string]string{}},
+		{name: "not a map of strings", snapshot: `{"values":{"/ls/a":"a"},"dirs":{}}`},
+		{name: "not an object", snapshot: `["lock"]`},
+		{name: "null", snapshot: `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/old", Value: []byte("old")})
+
+			err := (*fsm)(s.Store).Restore(ioutil.NopCloser(strings.NewReader(tt.snapshot)))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("restored an unrecognized snapshot")
+				}
+				if v, _ := s.value("/ls/old"); v != "old" {
+					t.Error("rejected snapshot changed the state")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := s.value("/ls/old"); exists {
+				t.Error("state from before the restore survived")
+			}
+			for key, want := range tt.want {
+				if got, exists := s.value(key); !exists || got != want {
+					t.Errorf("%s is %q (exists: %t), want %q", key, got, exists, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLegacyCommands(t *testing.T) {
+	s := newTestStore()
+	apply := func(data string) interface{} {
+		s.logIndex++
+		return (*fsm)(s.Store).Apply(&raft.Log{Index: s.logIndex, Data: []byte(data)})
+	}
+
+	if resp := apply(`{"op":"set","key":"lock","value":"a"}`); resp != nil {
+		t.Fatalf("got %v", resp)
+	}
+	if resp := apply(`{"op":"set","key":"Lock/Lock1","value":"b"}`); resp != nil {
+		t.Fatalf("got %v", resp)
+	}
+	if resp := apply(`{"op":"delete","key":"lock"}`); resp != nil {
+		t.Fatalf("got %v", resp)
+	}
+	if _, exists := s.value("lock"); exists {
+		t.Error("deleted key still exists")
+	}
+	if v, _ := s.value("Lock/Lock1"); v != "b" {
+		t.Errorf("got %q, want %q", v, "b")
+	}
+
+	var c command
+	if err := decodeCommand([]byte(`{"op":"rename","key":"lock"}`), &c); err == nil {
+		t.Error("decoded an op the baseline server never wrote")
+	}
+}
@@ -0,0 +1,127 @@
+// Metadata kept by the FSM for every file and directory.
+//
+// As in Chubby, every node has an instance number, which is greater than the
+// instance number of any earlier node with the same name, and generation
+// numbers for its content, lock and ACLs. Caches and auditors use these to
+// tell whether a file was replaced or just rewritten.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"time"
+)
+
+// Metadata of a file or directory. Times come from the command that made the
+// change, so that every replica computes the same metadata.
+type Metadata struct {
+	InstanceNumber		uint64
+	ContentGeneration	uint64     // Bumped on every write of the content.
+	ACLGeneration		uint64     // Bumped on every change of the ACLs.
+	Created				time.Time
+	Modified			time.Time
+	Checksum			uint64     // CRC-64 of the content.
+	ACL					api.ACL    // Inherited from the parent directory on creation.
+	EphemeralOwner		api.ClientID  // Session that created the file, if it is ephemeral.
+	Mandatory			bool       // Reads require holding the lock.
+}
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Stat returns the metadata of the given file or directory.
+func (s *Store) Stat(key string) (api.NodeStat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stat(key)
+}
+
+// Caller must hold s.mu.
+func (s *Store) stat(key string) (api.NodeStat, error) {
+	stat := api.NodeStat{}
+	if s.isDir(key) {
+		stat.Type = api.DIRECTORY
+	} else if value, exists := s.m[key]; exists {
+		stat.Type = api.FILE
+		stat.Size = len(value)
+	} else {
+		return stat, errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+
+	if m, exists := s.meta[key]; exists {
+		stat.InstanceNumber = m.InstanceNumber
+		stat.ContentGeneration = m.ContentGeneration
+		stat.ACLGeneration = m.ACLGeneration
+		stat.Created = m.Created
+		stat.Modified = m.Modified
+		stat.Checksum = m.Checksum
+		stat.ACL = m.ACL
+		stat.Ephemeral = m.EphemeralOwner != ""
+		stat.Mandatory = m.Mandatory
+	}
+	if l, exists := s.locks[key]; exists {
+		stat.LockGeneration = l.Generation
+	}
+	return stat, nil
+}
+
+// IsEphemeral returns whether key is an ephemeral file.
+func (s *Store) IsEphemeral(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, exists := s.meta[key]
+	return exists && m.EphemeralOwner != ""
+}
+
+// EphemeralFiles returns every ephemeral file along with the session that
+// created it.
+func (s *Store) EphemeralFiles() map[string]api.ClientID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make(map[string]api.ClientID)
+	for k, m := range s.meta {
+		if m.EphemeralOwner != "" {
+			files[k] = m.EphemeralOwner
+		}
+	}
+	return files
+}
+
+// Record the creation of a node with a fresh instance number. The node
+// starts with the ACLs of its parent directory. Caller must hold s.mu.
+func (s *Store) createMeta(key string, now time.Time) *Metadata {
+	s.nextInstance++
+	m := &Metadata{
+		InstanceNumber:	s.nextInstance,
+		Created:		now,
+		Modified:		now,
+		Checksum:		crc64.Checksum(nil, crcTable),
+	}
+	if p, exists := s.meta[parentDir(key)]; exists {
+		m.ACL = p.ACL
+	}
+	s.meta[key] = m
+	return m
+}
+
+// Record a write of the content of a node. Caller must hold s.mu.
+func (s *Store) updateMeta(key string, value []byte, now time.Time) {
+	m, exists := s.meta[key]
+	if !exists {
+		m = s.createMeta(key, now)
+	}
+	m.ContentGeneration++
+	m.Modified = now
+	m.Checksum = crc64.Checksum(value, crcTable)
+}
+
+// Returns a copy of the metadata.
+func (m *Metadata) clone() *Metadata {
+	c := *m
+	return &c
+}
@@ -0,0 +1,170 @@
+// Hierarchical namespace of the store: directory nodes and path checks.
+//
+// Paths look like Chubby paths, e.g. /ls/<cell>/dir/file. Every file and
+// directory must live in an existing directory, and only empty directories
+// can be deleted. The root directory /ls always exists.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Root of the namespace.
+const RootDir = "/ls"
+
+// Returns an error unless key is a clean, absolute path below RootDir.
+func checkPath(key string) error {
+	if !strings.HasPrefix(key, RootDir + "/") || path.Clean(key) != key {
+		return errors.New(fmt.Sprintf("invalid path %s: paths look like %s/<cell>/dir/file", key, RootDir))
+	}
+	return nil
+}
+
+// Returns the directory containing key.
+func parentDir(key string) string {
+	return path.Dir(key)
+}
+
+// IsDir returns whether key is a directory.
+func (s *Store) IsDir(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isDir(key)
+}
+
+// CreateDir creates a directory. Its parent directory must already exist.
+// Creating a directory that already exists succeeds.
+func (s *Store) CreateDir(key string) error {
+	if err := checkPath(key); err != nil {
+		return err
+	}
+
+	c := &command{
+		Op:  "mkdir",
+		Key: key,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// DeleteDir deletes a directory. The directory must be empty.
+func (s *Store) DeleteDir(key string) error {
+	if err := checkPath(key); err != nil {
+		return err
+	}
+
+	c := &command{
+		Op:  "rmdir",
+		Key: key,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// ListDir returns the children of a directory, sorted by name.
+func (s *Store) ListDir(key string) ([]api.DirEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isDir(key) {
+		return nil, errors.New(fmt.Sprintf("directory %s does not exist", key))
+	}
+
+	// The index is sorted, so the entries come out sorted by name.
+	entries := []api.DirEntry{}
+	for _, k := range s.index.childrenOf(key) {
+		if s.dirs[k] {
+			entries = append(entries, api.DirEntry{
+				Name: path.Base(k),
+				Type: api.DIRECTORY,
+				Mode: api.FREE,
+			})
+			continue
+		}
+		v := s.m[k]
+		entry := api.DirEntry{
+			Name: path.Base(k),
+			Type: api.FILE,
+			Mode: api.FREE,
+			Size: len(v),
+		}
+		if l, exists := s.locks[k]; exists {
+			entry.Mode = l.Mode
+			entry.Holders = len(l.Owners)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Caller must hold s.mu.
+func (s *Store) isDir(key string) bool {
+	return key == RootDir || s.dirs[key]
+}
+
+// Returns whether anything lives below the directory key.
+// Caller must hold s.mu.
+func (s *Store) hasChildren(key string) bool {
+	return s.index.children[key] > 0
+}
+
+// Returns an error unless a new file or directory may be created at key.
+// Caller must hold s.mu.
+func (s *Store) checkCreate(key string) error {
+	if err := checkPath(key); err != nil {
+		return err
+	}
+	if !s.isDir(parentDir(key)) {
+		return errors.New(fmt.Sprintf("parent directory %s does not exist", parentDir(key)))
+	}
+	return nil
+}
+
+func (f *fsm) applyMkdir(key string, now time.Time, q quotas) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dirs[key] {
+		return nil
+	}
+	if _, isFile := f.m[key]; isFile {
+		return errors.New(fmt.Sprintf("%s is a file", key))
+	}
+	if err := (*Store)(f).checkCreate(key); err != nil {
+		return err
+	}
+	d := newUsageDelta()
+	d.addNodes(key, 1)
+	if err := (*Store)(f).checkQuotas(d, q); err != nil {
+		return err
+	}
+	f.dirs[key] = true
+	f.index.insert(key)
+	(*Store)(f).notifyAdded(key)
+	(*Store)(f).createMeta(key, now)
+	return nil
+}
+
+func (f *fsm) applyRmdir(key string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirs[key] {
+		return errors.New(fmt.Sprintf("directory %s does not exist", key))
+	}
+	if (*Store)(f).hasChildren(key) {
+		return errors.New(fmt.Sprintf("directory %s is not empty", key))
+	}
+	delete(f.dirs, key)
+	delete(f.meta, key)
+	f.index.remove(key)
+	(*Store)(f).notifyRemoved(key)
+	return nil
+}
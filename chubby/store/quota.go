@@ -0,0 +1,145 @@
+// Quotas on the size of the namespace.
+//
+// Quotas are checked inside the FSM, so that no other change can slip in
+// between the check and the write. The leader stamps its limits into every
+// command, so a replica with different limits makes the same decision.
+// A limit of zero means no limit.
+//
+// The store keeps the number of children and the bytes of content below
+// every directory up to date as nodes change, so a check costs one lookup
+// per ancestor directory.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the quotas, as reported in QuotaExceededError.
+const (
+	QuotaNodesPerDir = api.QuotaNodesPerDir
+	QuotaSubtreeBytes = api.QuotaSubtreeBytes
+	QuotaLocksPerSession = api.QuotaLocksPerSession
+)
+
+// Returned when a change would take a node or session over one of its quotas.
+type QuotaExceededError = api.QuotaExceededError
+
+// Usage returns the quota usage of a directory: its number of children and
+// the total size of the files below it.
+func (s *Store) Usage(key string) (api.QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isDir(key) {
+		return api.QuotaUsage{}, errors.New(fmt.Sprintf("directory %s does not exist", key))
+	}
+	return api.QuotaUsage{
+		Path:				api.FilePath(key),
+		Children:			s.index.children[key],
+		MaxChildren:		s.MaxNodesPerDir,
+		Bytes:				s.bytes[key],
+		MaxBytes:			s.MaxSubtreeBytes,
+	}, nil
+}
+
+// Quota limits in force when the leader issued a command.
+type quotas struct {
+	MaxNodesPerDir	int
+	MaxSubtreeBytes	int
+}
+
+// Change in the usage of each directory that a command would make.
+type usageDelta struct {
+	children	map[string]int
+	bytes		map[string]int
+}
+
+func newUsageDelta() *usageDelta {
+	return &usageDelta{
+		children:	make(map[string]int),
+		bytes:		make(map[string]int),
+	}
+}
+
+// Count n nodes added to the directory containing key, or removed if n is
+// negative.
+func (d *usageDelta) addNodes(key string, n int) {
+	d.children[parentDir(key)] += n
+}
+
+// Count n bytes added below every directory above key, or removed if n is
+// negative.
+func (d *usageDelta) addBytes(key string, n int) {
+	for dir := parentDir(key); strings.HasPrefix(dir, RootDir); dir = parentDir(dir) {
+		d.bytes[dir] += n
+	}
+}
+
+// Returns a *QuotaExceededError if the change would take a directory over
+// one of the limits. Directories whose usage does not grow are let through
+// even if already over, e.g. after a limit was lowered. Caller must hold s.mu.
+func (s *Store) checkQuotas(d *usageDelta, q quotas) error {
+	maxNodes, maxBytes := q.MaxNodesPerDir, q.MaxSubtreeBytes
+	if maxNodes > 0 {
+		for _, dir := range sortedKeys(d.children) {
+			if n := d.children[dir]; n > 0 && s.index.children[dir] + n > maxNodes {
+				return &QuotaExceededError{Quota: QuotaNodesPerDir, Key: dir, Usage: s.index.children[dir] + n, Limit: maxNodes}
+			}
+		}
+	}
+	if maxBytes > 0 {
+		for _, dir := range sortedKeys(d.bytes) {
+			if n := d.bytes[dir]; n > 0 && s.bytes[dir] + n > maxBytes {
+				return &QuotaExceededError{Quota: QuotaSubtreeBytes, Key: dir, Usage: s.bytes[dir] + n, Limit: maxBytes}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the directories of m in reverse order, so that every replica
+// reports the same directory, and the one nearest the change comes before
+// the directories above it.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys
+}
+
+// Set the content of a file, keeping the byte totals of the directories
+// above it. Caller must hold s.mu.
+func (s *Store) setValue(key string, value []byte) {
+	s.addBytes(key, len(value) - len(s.m[key]))
+	s.m[key] = value
+}
+
+// Add n bytes to the totals of the directories above key. Caller must hold
+// s.mu.
+func (s *Store) addBytes(key string, n int) {
+	if n == 0 {
+		return
+	}
+	for dir := parentDir(key); strings.HasPrefix(dir, RootDir); dir = parentDir(dir) {
+		s.bytes[dir] += n
+		if s.bytes[dir] == 0 {
+			delete(s.bytes, dir)
+		}
+	}
+}
+
+// Recompute the byte totals of every directory, e.g. after a restore.
+// Caller must hold s.mu.
+func (s *Store) rebuildBytes() {
+	s.bytes = make(map[string]int)
+	for k, v := range s.m {
+		s.addBytes(k, len(v))
+	}
+}
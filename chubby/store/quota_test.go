@@ -0,0 +1,189 @@
+package store
+
+import (
+	"cos518project/chubby/api"
+	"testing"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	tests := []struct {
+		name      string
+		quotas    quotas
+		cmd       *command
+		locks     []string  // Files whose lock c1 holds before the command.
+		wantQuota string  // Quota exceeded, or "" if the command applies.
+		wantKey   string
+	}{
+		{
+			name:   "within limits",
+			quotas: quotas{MaxNodesPerDir: 3, MaxSubtreeBytes: 20},
+			cmd:    &command{Op: "set", Key: "/ls/d/new", Value: []byte("1234")},
+		},
+		{
+			name:      "too many children",
+			quotas:    quotas{MaxNodesPerDir: 2},
+			cmd:       &command{Op: "set", Key: "/ls/d/new"},
+			wantQuota: QuotaNodesPerDir,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:      "too many directories",
+			quotas:    quotas{MaxNodesPerDir: 2},
+			cmd:       &command{Op: "mkdir", Key: "/ls/d/dir"},
+			wantQuota: QuotaNodesPerDir,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:   "rewrite does not add a child",
+			quotas: quotas{MaxNodesPerDir: 2},
+			cmd:    &command{Op: "set", Key: "/ls/d/f", Value: []byte("abc")},
+		},
+		{
+			name:      "too many bytes below parent",
+			quotas:    quotas{MaxSubtreeBytes: 7},
+			cmd:       &command{Op: "set", Key: "/ls/d/sub/g", Value: []byte("gggggg")},
+			wantQuota: QuotaSubtreeBytes,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:   "shrinking is always allowed",
+			quotas: quotas{MaxSubtreeBytes: 1},
+			cmd:    &command{Op: "set", Key: "/ls/d/f", Value: []byte("a")},
+		},
+		{
+			name:      "compare-and-set",
+			quotas:    quotas{MaxSubtreeBytes: 7},
+			cmd:       &command{Op: "cas", Key: "/ls/d/f", Value: []byte("fffffff"), Generation: 1},
+			wantQuota: QuotaSubtreeBytes,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:      "rename into a full directory",
+			quotas:    quotas{MaxNodesPerDir: 2},
+			cmd:       &command{Op: "rename", Key: "/ls/e/h", NewKey: "/ls/d/h"},
+			wantQuota: QuotaNodesPerDir,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:   "rename within a directory",
+			quotas: quotas{MaxNodesPerDir: 2, MaxSubtreeBytes: 6},
+			cmd:    &command{Op: "rename", Key: "/ls/d/f", NewKey: "/ls/d/f2"},
+		},
+		{
+			name:      "rename brings bytes along",
+			quotas:    quotas{MaxSubtreeBytes: 7},
+			cmd:       &command{Op: "rename", Key: "/ls/e/h", NewKey: "/ls/d/sub/h"},
+			wantQuota: QuotaSubtreeBytes,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:   "transaction frees room before using it",
+			quotas: quotas{MaxNodesPerDir: 2, MaxSubtreeBytes: 6},
+			cmd: &command{Op: "txn", Client: "c1", Ops: []api.TxnOp{
+				{Type: api.TXN_DELETE, Filepath: "/ls/d/f"},
+				{Type: api.TXN_CREATE, Filepath: "/ls/d/f2", Content: []byte("xx")},
+			}},
+			locks:  []string{"/ls/d/f"},
+		},
+		{
+			name:   "transaction over quota as a whole",
+			quotas: quotas{MaxSubtreeBytes: 7},
+			cmd: &command{Op: "txn", Client: "c1", Ops: []api.TxnOp{
+				{Type: api.TXN_SET, Filepath: "/ls/d/f", Content: []byte("ffff")},
+				{Type: api.TXN_SET, Filepath: "/ls/d/sub/g", Content: []byte("gggg")},
+			}},
+			locks:     []string{"/ls/d/f", "/ls/d/sub/g"},
+			wantQuota: QuotaSubtreeBytes,
+			wantKey:   "/ls/d",
+		},
+		{
+			name:   "no limits",
+			cmd:    &command{Op: "set", Key: "/ls/d/sub/g", Value: make([]byte, 1000)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// /ls/d holds f (2 bytes) and sub, which holds g (2 bytes);
+			// /ls/e holds h (4 bytes). With a limit of 7 bytes, /ls is
+			// already over, which only matters for changes that grow it.
+			s := newTestStore()
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d/sub"})
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/e"})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f", Value: []byte("ff")})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/d/sub/g", Value: []byte("gg")})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/e/h", Value: []byte("hhhh")})
+			for _, key := range tt.locks {
+				s.mustCommit(t, &command{Op: "setlock", Key: key, Lock: &LockState{
+					Mode:   api.EXCLUSIVE,
+					Owners: map[api.ClientID]bool{"c1": true},
+				}})
+			}
+			before, _ := s.Usage("/ls/d")
+
+			tt.cmd.Quotas = tt.quotas
+			resp := s.commit(tt.cmd)
+			if tt.wantQuota == "" {
+				if err, failed := resp.(error); failed {
+					t.Fatalf("got error %s", err.Error())
+				}
+				return
+			}
+			qe, ok := resp.(*QuotaExceededError)
+			if !ok {
+				t.Fatalf("got %v, want *QuotaExceededError", resp)
+			}
+			if qe.Quota != tt.wantQuota || qe.Key != tt.wantKey {
+				t.Errorf("got %+v, want quota %q on %s", qe, tt.wantQuota, tt.wantKey)
+			}
+			if after, _ := s.Usage("/ls/d"); after != before {
+				t.Errorf("usage changed from %+v to %+v", before, after)
+			}
+		})
+	}
+}
+
+// The running totals must match a fresh count after every kind of change.
+func TestUsageTotals(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d/sub"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f", Value: []byte("12345")})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/sub/g", Value: []byte("123")})
+	s.mustCommit(t, &command{Op: "cas", Key: "/ls/d/f", Value: []byte("1"), Generation: 1})
+	s.mustCommit(t, &command{Op: "rename", Key: "/ls/d/sub", NewKey: "/ls/sub"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/sub/h", Value: []byte("12")})
+	s.mustCommit(t, &command{Op: "rmtree", Key: "/ls/sub"})
+	s.mustCommit(t, &command{Op: "txn", Ops: []api.TxnOp{
+		{Type: api.TXN_CREATE, Filepath: "/ls/d/t", Content: []byte("1234")},
+	}})
+
+	tests := []struct {
+		dir      string
+		children int
+		bytes    int
+	}{
+		{dir: "/ls", children: 1, bytes: 5},
+		{dir: "/ls/d", children: 2, bytes: 5},
+	}
+	for _, tt := range tests {
+		usage, err := s.Usage(tt.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Children != tt.children || usage.Bytes != tt.bytes {
+			t.Errorf("%s: got %d children and %d bytes, want %d and %d", tt.dir, usage.Children, usage.Bytes, tt.children, tt.bytes)
+		}
+	}
+
+	// A restore recomputes the same totals.
+	s.mu.Lock()
+	s.index.rebuild(s.m, s.dirs)
+	s.rebuildBytes()
+	s.mu.Unlock()
+	for _, tt := range tests {
+		if usage, _ := s.Usage(tt.dir); usage.Children != tt.children || usage.Bytes != tt.bytes {
+			t.Errorf("%s after rebuild: got %+v", tt.dir, usage)
+		}
+	}
+}
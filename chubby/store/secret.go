@@ -0,0 +1,37 @@
+// Cell secret, used by the servers to compute the check digits of handles.
+// It is replicated like any other state so that every master computes the
+// same check digits.
+
+package store
+
+// Secret returns a copy of the cell secret, or nil if none is set yet.
+func (s *Store) Secret() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.secret == nil {
+		return nil
+	}
+	return append([]byte(nil), s.secret...)
+}
+
+// SetSecret sets the cell secret unless one is set already: the first secret
+// applied wins, so that two masters racing to set it agree.
+func (s *Store) SetSecret(secret []byte) error {
+	c := &command{
+		Op:    "setsecret",
+		Value: secret,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+func (f *fsm) applySetSecret(secret []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.secret == nil {
+		f.secret = secret
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Session records, replicated so that a new master knows the sessions of the
+// previous one and can honour their leases.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"time"
+)
+
+// A session as recorded in the store. The locks a session holds are in the
+// lock table.
+type SessionRecord struct {
+	ClientID	api.ClientID
+	LeaseExpiry	time.Time     // Latest lease end the master has granted.
+	Handles		[]api.Handle  // Handles the client has open.
+}
+
+func (r *SessionRecord) clone() *SessionRecord {
+	c := *r
+	c.Handles = append([]api.Handle(nil), r.Handles...)
+	return &c
+}
+
+// Sessions returns a copy of every session record.
+func (s *Store) Sessions() map[api.ClientID]*SessionRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := make(map[api.ClientID]*SessionRecord)
+	for id, r := range s.sessions {
+		o[id] = r.clone()
+	}
+	return o
+}
+
+// SetSession creates or replaces the record of a session.
+func (s *Store) SetSession(record *SessionRecord) error {
+	c := &command{
+		Op:      "setsession",
+		Session: record,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// DeleteSession deletes the record of a session that ended.
+func (s *Store) DeleteSession(clientID api.ClientID) error {
+	c := &command{
+		Op:     "deletesession",
+		Client: clientID,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+func (f *fsm) applySetSession(record *SessionRecord) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sessions[record.ClientID] = record
+	return nil
+}
+
+func (f *fsm) applyDeleteSession(clientID api.ClientID) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.sessions, clientID)
+	return nil
+}
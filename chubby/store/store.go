@@ -16,7 +16,9 @@
 package store
 
 import (
-	"encoding/json"
+	"cos518project/chubby/api"
+	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +26,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,10 +40,65 @@ const (
 	raftTimeout         = 10 * time.Second
 )
 
+// Commands and snapshots are gob-encoded so that binary file contents are
+// stored as-is instead of being escaped. Entries in the older JSON format are
+// still decoded; see legacy.go.
+
 type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	Op    string
+	Key   string
+	Value []byte
+	Lock  *LockState
+	Locks map[string]*LockState
+	ACL   *api.ACL
+	Owner api.ClientID  // Session that owns a new ephemeral file, if any.
+	Mandatory bool
+	Guards []api.TxnGuard
+	Ops    []api.TxnOp
+	Client api.ClientID  // Client on whose behalf a transaction is applied.
+	Session *SessionRecord
+	NewKey string  // Destination of a rename.
+	Force  bool    // Delete or rename even if locks are held.
+	Time  time.Time  // When the leader issued the command.
+	Quotas quotas    // Limits of the leader; see quota.go.
+
+	// Content generation the file must have for a compare-and-set to apply.
+	Generation uint64
+}
+
+// Returned when a compare-and-set finds a different content generation
+// than the caller expected.
+type GenerationMismatchError struct {
+	Key			string
+	Expected	uint64
+	Actual		uint64
+}
+
+func (e *GenerationMismatchError) Error() string {
+	return fmt.Sprintf("content generation of %s is %d, expected %d", e.Key, e.Actual, e.Expected)
+}
+
+// LockState is the replicated state of a lock: its mode, who holds it, its
+// generation number and any lock-delay in effect. It lets a new leader know
+// the exact lock table.
+type LockState struct {
+	Mode		api.LockMode
+	Owners		map[api.ClientID]bool
+	Generation	uint64
+	LockDelay	time.Duration
+	Policy		api.LockPolicy
+	Capacity	int
+	DelayedUntil	time.Time	// Acquires fail until this time, after a non-voluntary release.
+}
+
+// Returns a deep copy of the lock state.
+func (l *LockState) clone() *LockState {
+	c := *l
+	c.Owners = make(map[api.ClientID]bool)
+	for owner, held := range l.Owners {
+		c.Owners[owner] = held
+	}
+	return &c
 }
 
 // Store defines a Raft-backed store.
@@ -50,19 +109,50 @@ type Store struct {
 	inmem 		bool         		// Whether storage is in-memory
 
 	mu			sync.Mutex   		// Lock for synchronizing API operations
-	m			map[string]string	// Key-value store for the system
+	m			map[string][]byte	// Key-value store for the system
+	dirs		map[string]bool		// Directory nodes of the namespace
+	meta		map[string]*Metadata	// Metadata of every file and directory
+	nextInstance	uint64			// Last instance number handed out
+	locks		map[string]*LockState	// Lock table for the system
+	index		keyIndex			// Names of all files and directories, sorted
+	bytes		map[string]int		// Bytes of content below each directory; see quota.go
+	secret		[]byte				// Key for the check digits of handles; see secret.go
+	sessions	map[api.ClientID]*SessionRecord	// Live sessions; see sessions.go
 
 	logger		*log.Logger  		// Logger
+
+	MaxFileSize	int					// Largest value that can be set, in bytes
+	MaxNodesPerDir	int				// Most children a directory may have
+	MaxSubtreeBytes	int				// Most bytes of content below a directory
+
+	// Called for every change applied to the FSM; see events.go.
+	Notify		func(event api.Event)
+
+	lastIndex	uint64				// Raft log index of the last applied command
+	applying	uint64				// Raft log index of the command being applied
+	history		[]api.WatchEvent	// Recent changes, oldest first; see watch.go
+	historyStart	uint64			// Every change after this index is in history
+	watchCh		chan struct{}		// Closed when a command is applied
 }
 
+// Returned when a value is larger than the maximum file size.
+type FileTooLargeError = api.FileTooLargeError
+
 // Returns a new store.
-func New(raftDir string, raftBind string, inmem bool) *Store {
+func New(raftDir string, raftBind string, inmem bool, maxFileSize int) *Store {
 	return &Store{
 		RaftDir: 	raftDir,
 		RaftBind: 	raftBind,
-		m:			make(map[string]string),
+		m:			make(map[string][]byte),
+		bytes:		make(map[string]int),
+		dirs:		make(map[string]bool),
+		meta:		make(map[string]*Metadata),
+		locks:		make(map[string]*LockState),
+		sessions:	make(map[api.ClientID]*SessionRecord),
 		inmem:		inmem,
 		logger: 	log.New(os.Stderr, "[store] ",  log.LstdFlags),
+		MaxFileSize:	maxFileSize,
+		watchCh:	make(chan struct{}),
 	}
 }
 
@@ -129,21 +219,25 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 }
 
 // Get returns the value for the given key.
-func (s *Store) Get(key string) (string, error) {
+func (s *Store) Get(key string) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	val, exists := s.m[key]
 	if !exists {
-		return "", errors.New(fmt.Sprintf("key %s does not exist", key))
+		return nil, errors.New(fmt.Sprintf("key %s does not exist", key))
 	}
-	return val, nil
+	return append([]byte{}, val...), nil
 }
 
-// Set sets the value for the given key.
-func (s *Store) Set(key, value string) error {
-	if s.Raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// Set sets the value for the given key. If the key does not exist yet,
+// its parent directory must exist.
+func (s *Store) Set(key string, value []byte) error {
+	if err := checkPath(key); err != nil {
+		return err
+	}
+	if err := s.CheckSize(key, value); err != nil {
+		return err
 	}
 
 	c := &command{
@@ -151,32 +245,180 @@ func (s *Store) Set(key, value string) error {
 		Key:   key,
 		Value: value,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
+	_, err := s.apply(c)
+	return err
+}
+
+// CreateEphemeral creates an empty ephemeral file owned by the given session.
+// Ephemeral files are deleted by the server once no session has them open.
+func (s *Store) CreateEphemeral(key string, owner api.ClientID) error {
+	if err := checkPath(key); err != nil {
 		return err
 	}
 
-	f := s.Raft.Apply(b, raftTimeout)
-	return f.Error()
+	c := &command{
+		Op:    "set",
+		Key:   key,
+		Owner: owner,
+	}
+	_, err := s.apply(c)
+	return err
 }
 
-// Delete deletes the given key.
-func (s *Store) Delete(key string) error {
-	if s.Raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// CompareAndSet sets the value for an existing key, but only if the content
+// generation of the key still equals expected. The check is made inside the
+// FSM, so no other write can slip in between. Returns the new content
+// generation, or a *GenerationMismatchError if the check fails.
+func (s *Store) CompareAndSet(key string, value []byte, expected uint64) (uint64, error) {
+	if err := s.CheckSize(key, value); err != nil {
+		return 0, err
+	}
+
+	c := &command{
+		Op:         "cas",
+		Key:        key,
+		Value:      value,
+		Generation: expected,
+	}
+	resp, err := s.apply(c)
+	if err != nil {
+		return 0, err
+	}
+	return resp.(uint64), nil
+}
+
+// CheckSize returns a *FileTooLargeError if the value is over the size limit,
+// so that it is rejected before reaching Raft.
+func (s *Store) CheckSize(key string, value []byte) error {
+	if s.MaxFileSize > 0 && len(value) > s.MaxFileSize {
+		return &FileTooLargeError{Key: key, Size: len(value), Limit: s.MaxFileSize}
 	}
+	return nil
+}
 
+// Delete deletes the given key.
+func (s *Store) Delete(key string) error {
 	c := &command{
 		Op:  "delete",
 		Key: key,
 	}
-	b, err := json.Marshal(c)
+	_, err := s.apply(c)
+	return err
+}
+
+// DeleteRecursive deletes a file, or a directory and everything below it.
+// Unless force is set, it fails if any lock in the subtree is held; forcing
+// releases those locks. Returns the files that were deleted.
+func (s *Store) DeleteRecursive(key string, force bool) ([]string, error) {
+	if err := checkPath(key); err != nil {
+		return nil, err
+	}
+
+	c := &command{
+		Op:    "rmtree",
+		Key:   key,
+		Force: force,
+	}
+	resp, err := s.apply(c)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return resp.([]string), nil
+}
+
+// Rename moves a file, or a directory and everything below it, to newKey.
+// Content, metadata and lock state move along with the nodes, so generation
+// numbers carry over. newKey must not exist and its parent directory must.
+// Unless force is set, it fails if any lock in the subtree is held; forcing
+// releases those locks. Returns the old names of the files that moved.
+func (s *Store) Rename(key, newKey string, force bool) ([]string, error) {
+	if err := checkPath(key); err != nil {
+		return nil, err
+	}
+	if err := checkPath(newKey); err != nil {
+		return nil, err
+	}
+	c := &command{
+		Op:     "rename",
+		Key:    key,
+		NewKey: newKey,
+		Force:  force,
+	}
+	resp, err := s.apply(c)
+	if err != nil {
+		return nil, err
+	}
+	return resp.([]string), nil
+}
+
+// GetLock returns a copy of the lock state for the given key.
+func (s *Store) GetLock(key string) (*LockState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, exists := s.locks[key]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("lock %s does not exist", key))
+	}
+	return l.clone(), nil
+}
+
+// Locks returns a copy of the whole lock table.
+func (s *Store) Locks() map[string]*LockState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := make(map[string]*LockState)
+	for k, l := range s.locks {
+		o[k] = l.clone()
+	}
+	return o
+}
+
+// SetLock sets the lock state for the given key.
+func (s *Store) SetLock(key string, state *LockState) error {
+	c := &command{
+		Op:   "setlock",
+		Key:  key,
+		Lock: state,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// SetLocks sets the lock state for several keys in a single log entry, so
+// that either all of them or none of them are applied.
+func (s *Store) SetLocks(states map[string]*LockState) error {
+	c := &command{
+		Op:    "setlocks",
+		Locks: states,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Apply a command through Raft and return the FSM's response. Errors
+// returned by the FSM (e.g. a missing parent directory) are returned as err.
+func (s *Store) apply(c *command) (interface{}, error) {
+	if s.Raft.State() != raft.Leader {
+		return nil, fmt.Errorf("not leader")
+	}
+
+	c.Time = time.Now()
+	c.Quotas = quotas{MaxNodesPerDir: s.MaxNodesPerDir, MaxSubtreeBytes: s.MaxSubtreeBytes}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(c); err != nil {
+		return nil, err
 	}
 
-	f := s.Raft.Apply(b, raftTimeout)
-	return f.Error()
+	f := s.Raft.Apply(b.Bytes(), raftTimeout)
+	if f.Error() != nil {
+		return nil, f.Error()
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
 }
 
 // Join joins a node, identified by nodeID and located at addr, to this store.
@@ -222,15 +464,50 @@ type fsm Store
 // Apply applies a Raft log entry to the key-value store.
 func (f *fsm) Apply(l *raft.Log) interface{} {
 	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
+	if err := decodeCommand(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
 
+	// Tag the changes made by this command with its log index. Watchers
+	// only see the index once all of the command's changes are recorded.
+	f.mu.Lock()
+	f.applying = l.Index
+	f.mu.Unlock()
+	defer (*Store)(f).wakeWatchers()
+
 	switch c.Op {
 	case "set":
-		return f.applySet(c.Key, c.Value)
+		return f.applySet(c.Key, c.Value, c.Owner, c.Time, c.Quotas)
 	case "delete":
 		return f.applyDelete(c.Key)
+	case "legacyset":
+		return f.applyLegacySet(c.Key, c.Value)
+	case "cas":
+		return f.applyCompareAndSet(c.Key, c.Value, c.Generation, c.Time, c.Quotas)
+	case "setlock":
+		return f.applySetLock(c.Key, c.Lock)
+	case "setlocks":
+		return f.applySetLocks(c.Locks)
+	case "mkdir":
+		return f.applyMkdir(c.Key, c.Time, c.Quotas)
+	case "rmdir":
+		return f.applyRmdir(c.Key)
+	case "setacl":
+		return f.applySetACL(c.Key, c.ACL, c.Time)
+	case "rmtree":
+		return f.applyDeleteRecursive(c.Key, c.Force)
+	case "rename":
+		return f.applyRename(c.Key, c.NewKey, c.Force, c.Quotas)
+	case "txn":
+		return f.applyTxn(c.Guards, c.Ops, c.Client, c.Time, c.Quotas)
+	case "setmandatory":
+		return f.applySetMandatory(c.Key, c.Mandatory, c.Time)
+	case "setsecret":
+		return f.applySetSecret(c.Value)
+	case "setsession":
+		return f.applySetSession(c.Session)
+	case "deletesession":
+		return f.applyDeleteSession(c.Client)
 	default:
 		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
 	}
@@ -241,56 +518,353 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Clone the map.
-	o := make(map[string]string)
+	// Clone the maps.
+	o := &fsmState{
+		Values:	make(map[string][]byte),
+		Dirs:	make(map[string]bool),
+		Meta:	make(map[string]*Metadata),
+		Locks:	make(map[string]*LockState),
+		Sessions:	make(map[api.ClientID]*SessionRecord),
+		NextInstance:	f.nextInstance,
+		LastIndex:	f.lastIndex,
+		Secret:	f.secret,
+	}
 	for k, v := range f.m {
-		o[k] = v
+		o.Values[k] = append([]byte{}, v...)
+	}
+	for k := range f.dirs {
+		o.Dirs[k] = true
+	}
+	for k, m := range f.meta {
+		o.Meta[k] = m.clone()
+	}
+	for k, l := range f.locks {
+		o.Locks[k] = l.clone()
+	}
+	for id, r := range f.sessions {
+		o.Sessions[id] = r.clone()
 	}
 	return &fsmSnapshot{store: o}, nil
 }
 
 // Restore stores the key-value store to a previous state.
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	o := &fsmState{}
+	if err := decodeState(rc, o); err != nil {
 		return err
 	}
+	if o.Values == nil {
+		o.Values = make(map[string][]byte)
+	}
+	if o.Dirs == nil {
+		o.Dirs = make(map[string]bool)
+	}
+	if o.Meta == nil {
+		o.Meta = make(map[string]*Metadata)
+	}
+	if o.Locks == nil {
+		o.Locks = make(map[string]*LockState)
+	}
+	if o.Sessions == nil {
+		o.Sessions = make(map[api.ClientID]*SessionRecord)
+	}
 
 	// Set the state from the snapshot, no lock required according to
 	// Hashicorp docs.
-	f.m = o
+	f.m = o.Values
+	f.dirs = o.Dirs
+	f.index.rebuild(f.m, f.dirs)
+	(*Store)(f).rebuildBytes()
+	f.meta = o.Meta
+	f.nextInstance = o.NextInstance
+	f.locks = o.Locks
+	f.secret = o.Secret
+	f.sessions = o.Sessions
+
+	// Changes before the snapshot are gone.
+	f.lastIndex = o.LastIndex
+	f.applying = o.LastIndex
+	f.history = nil
+	f.historyStart = o.LastIndex
 	return nil
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
+func (f *fsm) applySet(key string, value []byte, owner api.ClientID, now time.Time, q quotas) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.m[key] = value
+	if (*Store)(f).isDir(key) {
+		return errors.New(fmt.Sprintf("%s is a directory", key))
+	}
+	old, exists := f.m[key]
+	if !exists {
+		if err := (*Store)(f).checkCreate(key); err != nil {
+			return err
+		}
+	}
+	d := newUsageDelta()
+	if !exists {
+		d.addNodes(key, 1)
+	}
+	d.addBytes(key, len(value) - len(old))
+	if err := (*Store)(f).checkQuotas(d, q); err != nil {
+		return err
+	}
+	(*Store)(f).setValue(key, value)
+	f.index.insert(key)
+	(*Store)(f).updateMeta(key, value, now)
+	if exists {
+		(*Store)(f).notifyModified(key)
+	} else {
+		(*Store)(f).notifyAdded(key)
+	}
+
+	// Only a new file can be made ephemeral.
+	if !exists && owner != "" {
+		f.meta[key].EphemeralOwner = owner
+	}
 	return nil
 }
 
+func (f *fsm) applyCompareAndSet(key string, value []byte, expected uint64, now time.Time, q quotas) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old, exists := f.m[key]
+	if !exists {
+		return errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+
+	var actual uint64
+	if m, exists := f.meta[key]; exists {
+		actual = m.ContentGeneration
+	}
+	if actual != expected {
+		return &GenerationMismatchError{Key: key, Expected: expected, Actual: actual}
+	}
+	d := newUsageDelta()
+	d.addBytes(key, len(value) - len(old))
+	if err := (*Store)(f).checkQuotas(d, q); err != nil {
+		return err
+	}
+
+	(*Store)(f).setValue(key, value)
+	(*Store)(f).updateMeta(key, value, now)
+	(*Store)(f).notifyModified(key)
+	return f.meta[key].ContentGeneration
+}
+
 func (f *fsm) applyDelete(key string) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	delete(f.m, key)
+	(*Store)(f).deleteKey(key)
 	return nil
 }
 
+func (f *fsm) applyDeleteRecursive(key string, force bool) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := (*Store)(f)
+	files, dirs, err := s.subtree(key, force)
+	if err != nil {
+		return err
+	}
+	for _, k := range files {
+		s.deleteKey(k)
+	}
+	for _, k := range dirs {
+		delete(f.dirs, k)
+		delete(f.meta, k)
+		f.index.remove(k)
+		s.notifyRemoved(k)
+	}
+	return files
+}
+
+func (f *fsm) applyRename(key, newKey string, force bool, q quotas) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := (*Store)(f)
+	if newKey == key || strings.HasPrefix(newKey, key + "/") {
+		return errors.New(fmt.Sprintf("cannot move %s below itself", key))
+	}
+	if s.exists(newKey) {
+		return errors.New(fmt.Sprintf("%s already exists", newKey))
+	}
+	if err := s.checkCreate(newKey); err != nil {
+		return err
+	}
+	files, dirs, err := s.subtree(key, force)
+	if err != nil {
+		return err
+	}
+
+	// The subtree leaves its directory for another one. Directories above
+	// both keep their totals.
+	size := len(f.m[key])
+	if f.dirs[key] {
+		size = f.bytes[key]
+	}
+	d := newUsageDelta()
+	d.addNodes(key, -1)
+	d.addNodes(newKey, 1)
+	d.addBytes(key, -size)
+	d.addBytes(newKey, size)
+	if err := s.checkQuotas(d, q); err != nil {
+		return err
+	}
+
+	rename := func(k string) string {
+		return newKey + strings.TrimPrefix(k, key)
+	}
+	for _, k := range dirs {
+		delete(f.dirs, k)
+		f.index.remove(k)
+		s.notifyRemoved(k)
+		f.dirs[rename(k)] = true
+		f.index.insert(rename(k))
+		s.notifyAdded(rename(k))
+		if m, exists := f.meta[k]; exists {
+			f.meta[rename(k)] = m
+			delete(f.meta, k)
+		}
+	}
+	for _, k := range files {
+		nk := rename(k)
+		s.setValue(nk, f.m[k])
+		f.index.insert(nk)
+		s.notifyAdded(nk)
+		if m, exists := f.meta[k]; exists {
+			f.meta[nk] = m
+		}
+
+		// The lock moves with its file, released if the rename was forced.
+		// A forced release bumps its generation so that the sequencers of
+		// its holders stay invalid. The generation must not go below that
+		// of a lock deleted earlier under the new name.
+		if l, exists := f.locks[k]; exists {
+			moved := l.clone()
+			if len(moved.Owners) > 0 {
+				moved.Generation++
+			}
+			moved.Mode = api.FREE
+			moved.Owners = make(map[api.ClientID]bool)
+			if old, exists := f.locks[nk]; exists && old.Generation > moved.Generation {
+				moved.Generation = old.Generation
+			}
+			f.locks[nk] = moved
+		}
+		s.deleteKey(k)
+	}
+	return files
+}
+
+// Returns the files and directories at or below key, directories deepest
+// first. Unless force is set, fails if a lock on any of the files is held.
+// Caller must hold s.mu.
+func (s *Store) subtree(key string, force bool) ([]string, []string, error) {
+	if key == RootDir || !s.exists(key) {
+		return nil, nil, errors.New(fmt.Sprintf("key %s does not exist", key))
+	}
+
+	files := []string{}
+	dirs := []string{}
+	for _, k := range append([]string{key}, s.index.withPrefix(key + "/")...) {
+		if s.dirs[k] {
+			dirs = append(dirs, k)
+		} else {
+			files = append(files, k)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i] > dirs[j]
+	})
+
+	if !force {
+		for _, k := range files {
+			if l, exists := s.locks[k]; exists && len(l.Owners) > 0 {
+				return nil, nil, errors.New(fmt.Sprintf("lock at %s is held", k))
+			}
+		}
+	}
+	return files, dirs, nil
+}
+
+// Caller must hold s.mu.
+func (s *Store) deleteKey(key string) {
+	s.addBytes(key, -len(s.m[key]))
+	delete(s.m, key)
+	delete(s.meta, key)
+	s.index.remove(key)
+	s.notifyRemoved(key)
+
+	// Keep the generation number around so that it never goes backwards,
+	// even if a lock with the same name is created again. A forced release
+	// bumps it so that the sequencers of its holders stay invalid.
+	if l, exists := s.locks[key]; exists {
+		generation := l.Generation
+		if len(l.Owners) > 0 {
+			generation++
+		}
+		s.locks[key] = &LockState{
+			Mode:		api.FREE,
+			Owners:		make(map[api.ClientID]bool),
+			Generation:	generation,
+		}
+	}
+}
+
+func (f *fsm) applySetLock(key string, state *LockState) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if state.Owners == nil {
+		state.Owners = make(map[api.ClientID]bool)
+	}
+	(*Store)(f).notifyAcquired(key, state)
+	f.locks[key] = state
+	return nil
+}
+
+func (f *fsm) applySetLocks(states map[string]*LockState) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, state := range states {
+		if state.Owners == nil {
+			state.Owners = make(map[api.ClientID]bool)
+		}
+		(*Store)(f).notifyAcquired(key, state)
+		f.locks[key] = state
+	}
+	return nil
+}
+
+// State of the FSM as written to snapshots.
+type fsmState struct {
+	Values		map[string][]byte
+	Dirs		map[string]bool
+	Meta		map[string]*Metadata
+	NextInstance	uint64
+	Locks		map[string]*LockState
+	LastIndex	uint64
+	Secret		[]byte
+	Sessions	map[api.ClientID]*SessionRecord
+}
+
 // Implement interface for type FSMSnapshot.
 type fsmSnapshot struct {
-	store map[string]string
+	store *fsmState
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
 		// Encode data.
-		b, err := json.Marshal(f.store)
-		if err != nil {
+		var b bytes.Buffer
+		if err := gob.NewEncoder(&b).Encode(f.store); err != nil {
 			return err
 		}
 
 		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
+		if _, err := sink.Write(b.Bytes()); err != nil {
 			return err
 		}
 
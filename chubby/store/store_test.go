@@ -0,0 +1,271 @@
+package store
+
+import (
+	"bytes"
+	"cos518project/chubby/api"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// A store without Raft, whose FSM the tests drive directly with log entries.
+type testStore struct {
+	*Store
+	logIndex uint64  // Index of the last log entry applied.
+}
+
+func newTestStore() *testStore {
+	return &testStore{Store: New("", "", true, 0)}
+}
+
+// Apply a command as the next log entry, as a follower would, and return
+// the response of the FSM.
+func (s *testStore) commit(c *command) interface{} {
+	if c.Time.IsZero() {
+		c.Time = time.Unix(1, 0)
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(c); err != nil {
+		panic(err)
+	}
+	s.logIndex++
+	return (*fsm)(s.Store).Apply(&raft.Log{Index: s.logIndex, Data: b.Bytes()})
+}
+
+// Apply a command that must succeed.
+func (s *testStore) mustCommit(t *testing.T, c *command) interface{} {
+	t.Helper()
+	resp := s.commit(c)
+	if err, ok := resp.(error); ok {
+		t.Fatalf("%s %s: %s", c.Op, c.Key, err.Error())
+	}
+	return resp
+}
+
+func (s *testStore) value(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, exists := s.m[key]
+	return string(v), exists
+}
+
+// Check the content of files; "" means the file must be missing.
+func assertContents(t *testing.T, s *testStore, want map[string]string) {
+	t.Helper()
+	for key, w := range want {
+		got, exists := s.value(key)
+		if w == "" && exists {
+			t.Errorf("%s exists with %q, want missing", key, got)
+		} else if w != "" && got != w {
+			t.Errorf("%s is %q, want %q", key, got, w)
+		}
+	}
+}
+
+func TestApplyCompareAndSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		expected   uint64
+		wantErr    bool
+		wantValue  string
+		wantGen    uint64
+	}{
+		{name: "matching generation", expected: 1, wantValue: "new", wantGen: 2},
+		{name: "stale generation", expected: 0, wantErr: true, wantValue: "old"},
+		{name: "future generation", expected: 5, wantErr: true, wantValue: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/f", Value: []byte("old")})
+
+			resp := s.commit(&command{Op: "cas", Key: "/ls/f", Value: []byte("new"), Generation: tt.expected})
+			if tt.wantErr {
+				mismatch, ok := resp.(*GenerationMismatchError)
+				if !ok {
+					t.Fatalf("got %v, want *GenerationMismatchError", resp)
+				}
+				if mismatch.Actual != 1 || mismatch.Expected != tt.expected {
+					t.Errorf("got %+v, want actual 1 and expected %d", mismatch, tt.expected)
+				}
+			} else if resp != tt.wantGen {
+				t.Errorf("got generation %v, want %d", resp, tt.wantGen)
+			}
+			if v, _ := s.value("/ls/f"); v != tt.wantValue {
+				t.Errorf("got value %q, want %q", v, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestApplyCompareAndSetMissingFile(t *testing.T) {
+	s := newTestStore()
+	if _, ok := s.commit(&command{Op: "cas", Key: "/ls/f", Value: []byte("x")}).(error); !ok {
+		t.Fatal("compare-and-set of a missing file succeeded")
+	}
+	if _, exists := s.value("/ls/f"); exists {
+		t.Error("compare-and-set created the file")
+	}
+}
+
+func TestApplyRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		newKey  string
+		force   bool
+		wantErr bool
+		want    map[string]string  // Files after the rename; "" means missing.
+	}{
+		{
+			name:   "file",
+			key:    "/ls/d/f",
+			newKey: "/ls/e/f2",
+			want:   map[string]string{"/ls/d/f": "", "/ls/e/f2": "f"},
+		},
+		{
+			name:   "directory with everything below it",
+			key:    "/ls/d",
+			newKey: "/ls/e/d",
+			force:  true,
+			want:   map[string]string{"/ls/d/f": "", "/ls/d/sub/g": "", "/ls/e/d/f": "f", "/ls/e/d/sub/g": "g"},
+		},
+		{
+			name:    "held lock in subtree",
+			key:     "/ls/d",
+			newKey:  "/ls/e/d",
+			wantErr: true,
+			want:    map[string]string{"/ls/d/sub/g": "g", "/ls/e/d/sub/g": ""},
+		},
+		{
+			name:    "below itself",
+			key:     "/ls/d",
+			newKey:  "/ls/d/sub/d",
+			force:   true,
+			wantErr: true,
+			want:    map[string]string{"/ls/d/f": "f"},
+		},
+		{
+			name:    "onto existing node",
+			key:     "/ls/d/f",
+			newKey:  "/ls/d/sub/g",
+			wantErr: true,
+			want:    map[string]string{"/ls/d/f": "f", "/ls/d/sub/g": "g"},
+		},
+		{
+			name:    "missing parent directory",
+			key:     "/ls/d/f",
+			newKey:  "/ls/none/f",
+			wantErr: true,
+			want:    map[string]string{"/ls/d/f": "f"},
+		},
+		{
+			name:    "missing source",
+			key:     "/ls/none",
+			newKey:  "/ls/e/none",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d/sub"})
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/e"})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f", Value: []byte("f")})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/d/sub/g", Value: []byte("g")})
+			s.mustCommit(t, &command{Op: "setlock", Key: "/ls/d/sub/g", Lock: &LockState{
+				Mode:       api.EXCLUSIVE,
+				Owners:     map[api.ClientID]bool{"c1": true},
+				Generation: 3,
+			}})
+
+			resp := s.commit(&command{Op: "rename", Key: tt.key, NewKey: tt.newKey, Force: tt.force})
+			if _, failed := resp.(error); failed != tt.wantErr {
+				t.Fatalf("got %v, want error: %t", resp, tt.wantErr)
+			}
+			assertContents(t, s, tt.want)
+		})
+	}
+}
+
+func TestApplyRenameMovesMetadataAndLocks(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f", Value: []byte("1")})
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f", Value: []byte("2")})
+	s.mustCommit(t, &command{Op: "setlock", Key: "/ls/d/f", Lock: &LockState{
+		Mode:       api.EXCLUSIVE,
+		Owners:     map[api.ClientID]bool{"c1": true},
+		Generation: 4,
+	}})
+	before, _ := s.Stat("/ls/d/f")
+
+	s.mustCommit(t, &command{Op: "rename", Key: "/ls/d", NewKey: "/ls/moved", Force: true})
+
+	after, err := s.Stat("/ls/moved/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.InstanceNumber != before.InstanceNumber || after.ContentGeneration != before.ContentGeneration {
+		t.Errorf("got %+v after the rename, want the metadata of %+v", after, before)
+	}
+	if s.IsDir("/ls/d") || !s.IsDir("/ls/moved") {
+		t.Error("directory did not move")
+	}
+
+	// A forced rename releases the lock, which bumps its generation.
+	l, err := s.GetLock("/ls/moved/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Mode != api.FREE || len(l.Owners) != 0 || l.Generation != 5 {
+		t.Errorf("got lock %+v, want it free with generation 5", l)
+	}
+}
+
+// A delete that releases a held lock bumps its generation, so that a
+// sequencer of the old holder does not pass once the file is recreated and
+// locked again.
+func TestDeleteReleasesLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		owners  map[api.ClientID]bool
+		cmd     *command
+		wantGen uint64
+	}{
+		{name: "forced delete of held lock", owners: map[api.ClientID]bool{"c1": true}, cmd: &command{Op: "rmtree", Key: "/ls/d", Force: true}, wantGen: 4},
+		{name: "delete of free lock", cmd: &command{Op: "rmtree", Key: "/ls/d"}, wantGen: 3},
+		{name: "transaction delete of held lock", owners: map[api.ClientID]bool{"c1": true}, cmd: &command{Op: "txn", Client: "c1", Ops: []api.TxnOp{
+			{Type: api.TXN_DELETE, Filepath: "/ls/d/f"},
+		}}, wantGen: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore()
+			s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/d"})
+			s.mustCommit(t, &command{Op: "set", Key: "/ls/d/f"})
+			mode := api.FREE
+			if len(tt.owners) > 0 {
+				mode = api.EXCLUSIVE
+			}
+			s.mustCommit(t, &command{Op: "setlock", Key: "/ls/d/f", Lock: &LockState{
+				Mode:       mode,
+				Owners:     tt.owners,
+				Generation: 3,
+			}})
+
+			s.mustCommit(t, tt.cmd)
+
+			l, err := s.GetLock("/ls/d/f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Mode != api.FREE || len(l.Owners) != 0 || l.Generation != tt.wantGen {
+				t.Errorf("got lock %+v, want it free with generation %d", l, tt.wantGen)
+			}
+		})
+	}
+}
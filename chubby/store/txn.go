@@ -0,0 +1,188 @@
+// Transactions: several writes applied atomically as one Raft log entry.
+//
+// A transaction first checks its guards, then checks that every operation
+// can be applied, and only then applies them in order. If anything fails,
+// the FSM is left untouched.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned when a guard of a transaction does not hold.
+type GuardFailedError struct {
+	Index	int  // Index of the guard in the transaction.
+	Guard	api.TxnGuard
+}
+
+func (e *GuardFailedError) Error() string {
+	return fmt.Sprintf("guard %d of transaction on %s does not hold", e.Index, e.Guard.Filepath)
+}
+
+// Txn applies ops if all the guards hold, on behalf of the given client.
+// Returns a *GuardFailedError if a guard does not hold, or another error if
+// an operation cannot be applied; in both cases nothing is applied.
+func (s *Store) Txn(guards []api.TxnGuard, ops []api.TxnOp, client api.ClientID) error {
+	for _, op := range ops {
+		key := string(op.Filepath)
+		if err := checkPath(key); err != nil {
+			return err
+		}
+		if err := s.CheckSize(key, op.Content); err != nil {
+			return err
+		}
+	}
+
+	c := &command{
+		Op:     "txn",
+		Guards: guards,
+		Ops:    ops,
+		Client: client,
+	}
+	_, err := s.apply(c)
+	return err
+}
+
+// Returns a *GuardFailedError for the first guard that does not hold.
+// Caller must hold s.mu.
+func (s *Store) checkGuards(guards []api.TxnGuard, client api.ClientID) error {
+	for i, g := range guards {
+		key := string(g.Filepath)
+		var holds bool
+		switch g.Type {
+		case api.GUARD_EXISTS:
+			holds = s.exists(key)
+		case api.GUARD_GENERATION:
+			_, isFile := s.m[key]
+			m, exists := s.meta[key]
+			holds = isFile && exists && m.ContentGeneration == g.Generation
+		case api.GUARD_LOCK_HELD:
+			l, exists := s.locks[key]
+			holds = exists && l.Owners[client]
+		default:
+			return errors.New(fmt.Sprintf("unknown guard type %d", g.Type))
+		}
+		if !holds {
+			return &GuardFailedError{Index: i, Guard: g}
+		}
+	}
+	return nil
+}
+
+// Returns an error unless every op can be applied in order and the
+// transaction as a whole stays within the quotas. Files created or deleted
+// by earlier ops are taken into account. Caller must hold s.mu.
+func (s *Store) checkOps(ops []api.TxnOp, client api.ClientID, q quotas) error {
+	// Whether each key touched so far exists after the ops before it, and
+	// its size.
+	files := make(map[string]bool)
+	sizes := make(map[string]int)
+	isFile := func(key string) bool {
+		if exists, touched := files[key]; touched {
+			return exists
+		}
+		_, exists := s.m[key]
+		return exists
+	}
+	size := func(key string) int {
+		if n, touched := sizes[key]; touched {
+			return n
+		}
+		return len(s.m[key])
+	}
+	// Files created by the transaction have no lock yet, so later ops may
+	// change them freely.
+	created := make(map[string]bool)
+	d := newUsageDelta()
+
+	for _, op := range ops {
+		key := string(op.Filepath)
+		switch op.Type {
+		case api.TXN_CREATE:
+			if isFile(key) || s.isDir(key) {
+				return errors.New(fmt.Sprintf("%s already exists", key))
+			}
+			if err := s.checkCreate(key); err != nil {
+				return err
+			}
+			files[key] = true
+			created[key] = true
+			d.addNodes(key, 1)
+			d.addBytes(key, len(op.Content))
+			sizes[key] = len(op.Content)
+		case api.TXN_SET:
+			if !isFile(key) {
+				return errors.New(fmt.Sprintf("file %s does not exist", key))
+			}
+			// Like WriteContent, writing needs the lock.
+			if l, exists := s.locks[key]; !created[key] && !(exists && l.Owners[client]) {
+				return errors.New(fmt.Sprintf("client %s does not hold the lock at %s", client, key))
+			}
+			d.addBytes(key, len(op.Content) - size(key))
+			sizes[key] = len(op.Content)
+		case api.TXN_DELETE:
+			if !isFile(key) {
+				return errors.New(fmt.Sprintf("file %s does not exist", key))
+			}
+			// Like DeleteLock, deleting needs the lock in EXCLUSIVE mode,
+			// or to be the only holder of a semaphore.
+			if !created[key] && !s.holdsExclusive(key, client) {
+				return errors.New(fmt.Sprintf("client %s does not hold the lock at %s in exclusive mode", client, key))
+			}
+			files[key] = false
+			delete(created, key)
+			d.addNodes(key, -1)
+			d.addBytes(key, -size(key))
+			sizes[key] = 0
+		default:
+			return errors.New(fmt.Sprintf("unknown operation type %d", op.Type))
+		}
+	}
+	return s.checkQuotas(d, q)
+}
+
+// Returns whether the client holds the lock at key in EXCLUSIVE mode, or
+// is the only holder of the semaphore. Caller must hold s.mu.
+func (s *Store) holdsExclusive(key string, client api.ClientID) bool {
+	l, exists := s.locks[key]
+	if !exists || !l.Owners[client] {
+		return false
+	}
+	return l.Mode == api.EXCLUSIVE || (l.Mode == api.SEMAPHORE && len(l.Owners) == 1)
+}
+
+func (f *fsm) applyTxn(guards []api.TxnGuard, ops []api.TxnOp, client api.ClientID, now time.Time, q quotas) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := (*Store)(f)
+	if err := s.checkGuards(guards, client); err != nil {
+		return err
+	}
+	if err := s.checkOps(ops, client, q); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		key := string(op.Filepath)
+		switch op.Type {
+		case api.TXN_CREATE, api.TXN_SET:
+			_, exists := f.m[key]
+			s.setValue(key, op.Content)
+			f.index.insert(key)
+			s.updateMeta(key, op.Content, now)
+			if exists {
+				s.notifyModified(key)
+			} else {
+				s.notifyAdded(key)
+			}
+		case api.TXN_DELETE:
+			s.deleteKey(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"cos518project/chubby/api"
+	"testing"
+)
+
+func TestApplyTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		guards    []api.TxnGuard
+		ops       []api.TxnOp
+		wantGuard bool               // Fails with a *GuardFailedError.
+		wantErr   bool               // Fails with another error.
+		want      map[string]string  // Files after the transaction; "" means missing.
+	}{
+		{
+			name: "create, set and delete",
+			ops: []api.TxnOp{
+				{Type: api.TXN_CREATE, Filepath: "/ls/new", Content: []byte("n")},
+				{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("a2")},
+				{Type: api.TXN_DELETE, Filepath: "/ls/b"},
+			},
+			want: map[string]string{"/ls/new": "n", "/ls/a": "a2", "/ls/b": ""},
+		},
+		{
+			name:   "guards hold",
+			guards: []api.TxnGuard{
+				{Type: api.GUARD_EXISTS, Filepath: "/ls/a"},
+				{Type: api.GUARD_GENERATION, Filepath: "/ls/a", Generation: 1},
+			},
+			ops:  []api.TxnOp{{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("a2")}},
+			want: map[string]string{"/ls/a": "a2"},
+		},
+		{
+			name:      "missing node",
+			guards:    []api.TxnGuard{{Type: api.GUARD_EXISTS, Filepath: "/ls/none"}},
+			ops:       []api.TxnOp{{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("a2")}},
+			wantGuard: true,
+			want:      map[string]string{"/ls/a": "a"},
+		},
+		{
+			name:      "stale generation",
+			guards:    []api.TxnGuard{{Type: api.GUARD_GENERATION, Filepath: "/ls/a", Generation: 7}},
+			ops:       []api.TxnOp{{Type: api.TXN_DELETE, Filepath: "/ls/a"}},
+			wantGuard: true,
+			want:      map[string]string{"/ls/a": "a"},
+		},
+		{
+			name:      "lock not held",
+			guards:    []api.TxnGuard{{Type: api.GUARD_LOCK_HELD, Filepath: "/ls/c"}},
+			ops:       []api.TxnOp{{Type: api.TXN_DELETE, Filepath: "/ls/a"}},
+			wantGuard: true,
+			want:      map[string]string{"/ls/a": "a"},
+		},
+		{
+			name:    "set of a file locked by another client",
+			ops:     []api.TxnOp{{Type: api.TXN_SET, Filepath: "/ls/c", Content: []byte("c2")}},
+			wantErr: true,
+			want:    map[string]string{"/ls/c": "c"},
+		},
+		{
+			name:    "set of an unlocked file",
+			ops:     []api.TxnOp{{Type: api.TXN_SET, Filepath: "/ls/u", Content: []byte("u2")}},
+			wantErr: true,
+			want:    map[string]string{"/ls/u": "u"},
+		},
+		{
+			name:    "delete of an unlocked file",
+			ops:     []api.TxnOp{{Type: api.TXN_DELETE, Filepath: "/ls/u"}},
+			wantErr: true,
+			want:    map[string]string{"/ls/u": "u"},
+		},
+		{
+			name:    "delete of a file locked in shared mode",
+			ops:     []api.TxnOp{{Type: api.TXN_DELETE, Filepath: "/ls/s"}},
+			wantErr: true,
+			want:    map[string]string{"/ls/s": "s"},
+		},
+		{
+			name: "set and delete of a file the transaction created",
+			ops: []api.TxnOp{
+				{Type: api.TXN_CREATE, Filepath: "/ls/n", Content: []byte("n")},
+				{Type: api.TXN_SET, Filepath: "/ls/n", Content: []byte("n2")},
+				{Type: api.TXN_CREATE, Filepath: "/ls/m", Content: []byte("m")},
+				{Type: api.TXN_DELETE, Filepath: "/ls/m"},
+			},
+			want: map[string]string{"/ls/n": "n2", "/ls/m": ""},
+		},
+		{
+			name: "later op fails, nothing applied",
+			ops: []api.TxnOp{
+				{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("a2")},
+				{Type: api.TXN_SET, Filepath: "/ls/none", Content: []byte("x")},
+			},
+			wantErr: true,
+			want:    map[string]string{"/ls/a": "a", "/ls/none": ""},
+		},
+		{
+			name: "create over existing file",
+			ops:  []api.TxnOp{{Type: api.TXN_CREATE, Filepath: "/ls/a"}},
+			wantErr: true,
+			want:    map[string]string{"/ls/a": "a"},
+		},
+		{
+			name: "ops see earlier ops",
+			ops: []api.TxnOp{
+				{Type: api.TXN_DELETE, Filepath: "/ls/a"},
+				{Type: api.TXN_CREATE, Filepath: "/ls/a", Content: []byte("again")},
+				{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("again2")},
+			},
+			want: map[string]string{"/ls/a": "again2"},
+		},
+		{
+			name: "set after delete",
+			ops: []api.TxnOp{
+				{Type: api.TXN_DELETE, Filepath: "/ls/a"},
+				{Type: api.TXN_SET, Filepath: "/ls/a", Content: []byte("x")},
+			},
+			wantErr: true,
+			want:    map[string]string{"/ls/a": "a"},
+		},
+		{
+			name: "create without parent directory",
+			ops:  []api.TxnOp{{Type: api.TXN_CREATE, Filepath: "/ls/dir/f"}},
+			wantErr: true,
+			want:    map[string]string{"/ls/dir/f": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// c1 holds the locks of a and b, c2 that of c, and both
+			// share that of s. Nobody holds the lock of u.
+			s := newTestStore()
+			for _, key := range []string{"a", "b", "c", "s", "u"} {
+				s.mustCommit(t, &command{Op: "set", Key: "/ls/" + key, Value: []byte(key)})
+			}
+			s.mustCommit(t, &command{Op: "setlocks", Locks: map[string]*LockState{
+				"/ls/a": {Mode: api.EXCLUSIVE, Owners: map[api.ClientID]bool{"c1": true}},
+				"/ls/b": {Mode: api.EXCLUSIVE, Owners: map[api.ClientID]bool{"c1": true}},
+				"/ls/c": {Mode: api.EXCLUSIVE, Owners: map[api.ClientID]bool{"c2": true}},
+				"/ls/s": {Mode: api.SHARED, Owners: map[api.ClientID]bool{"c1": true, "c2": true}},
+			}})
+
+			resp := s.commit(&command{Op: "txn", Guards: tt.guards, Ops: tt.ops, Client: "c1"})
+			_, guardFailed := resp.(*GuardFailedError)
+			err, failed := resp.(error)
+			switch {
+			case tt.wantGuard && !guardFailed:
+				t.Errorf("got %v, want *GuardFailedError", resp)
+			case tt.wantErr && (!failed || guardFailed):
+				t.Errorf("got %v, want an error other than *GuardFailedError", resp)
+			case !tt.wantGuard && !tt.wantErr && failed:
+				t.Errorf("got error %s", err.Error())
+			}
+
+			assertContents(t, s, tt.want)
+		})
+	}
+}
+
+func TestApplyTxnLockHeldByOther(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/a", Value: []byte("a")})
+	s.mustCommit(t, &command{Op: "setlock", Key: "/ls/a", Lock: &LockState{
+		Mode:   api.EXCLUSIVE,
+		Owners: map[api.ClientID]bool{"c2": true},
+	}})
+
+	// c2 holds the lock, so its guard holds and it may delete the file,
+	// but c1 may do neither.
+	guards := []api.TxnGuard{{Type: api.GUARD_LOCK_HELD, Filepath: "/ls/a"}}
+	if _, ok := s.commit(&command{Op: "txn", Guards: guards, Client: "c1"}).(*GuardFailedError); !ok {
+		t.Error("lock guard held for a client that does not hold the lock")
+	}
+	ops := []api.TxnOp{{Type: api.TXN_DELETE, Filepath: "/ls/a"}}
+	if _, ok := s.commit(&command{Op: "txn", Ops: ops, Client: "c1"}).(error); !ok {
+		t.Error("deleted a file whose lock another client holds")
+	}
+	s.mustCommit(t, &command{Op: "txn", Guards: guards, Ops: ops, Client: "c2"})
+	if _, exists := s.value("/ls/a"); exists {
+		t.Error("holder could not delete the file")
+	}
+}
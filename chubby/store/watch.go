@@ -0,0 +1,110 @@
+// Bounded history of changes for Watch.
+//
+// Every replica records the changes it applies, tagged with the Raft log
+// index of the command. Log indexes are the same on every replica, so a
+// watcher that moves to another server after a failover can resume from the
+// last index it saw. Only the most recent changes are kept; a watcher that
+// falls further behind gets a *CompactedError and must start over.
+
+package store
+
+import (
+	"cos518project/chubby/api"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Most changes kept in the history.
+const MaxWatchHistory = 10000
+
+// Returned when the history no longer has the changes a watcher asked for.
+type CompactedError struct {
+	FromIndex	uint64
+	Oldest		uint64  // Watches must start at this index or later.
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("compacted: changes after index %d are gone, oldest index is %d", e.FromIndex, e.Oldest)
+}
+
+// Watch returns the changes after fromIndex to nodes whose path starts with
+// prefix, waiting up to timeout for one to happen. A fromIndex of 0 starts
+// at the oldest change still in the history. It also returns the index to
+// pass as fromIndex next time, which moves forward even if no change
+// matched.
+func (s *Store) Watch(prefix string, fromIndex uint64, timeout time.Duration) ([]api.WatchEvent, uint64, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		if fromIndex == 0 {
+			fromIndex = s.historyStart
+		}
+		if fromIndex < s.historyStart {
+			s.mu.Unlock()
+			return nil, 0, &CompactedError{FromIndex: fromIndex, Oldest: s.historyStart}
+		}
+		// Changes of a command still being applied are left for next time.
+		events := []api.WatchEvent{}
+		for _, e := range s.history {
+			if e.Index > s.lastIndex {
+				break
+			}
+			if e.Index > fromIndex && strings.HasPrefix(string(changedNode(e.Event)), prefix) {
+				events = append(events, e)
+			}
+		}
+		nextIndex := s.lastIndex
+		if fromIndex > nextIndex {
+			nextIndex = fromIndex
+		}
+		watchCh := s.watchCh
+		s.mu.Unlock()
+
+		if len(events) > 0 {
+			return events, nextIndex, nil
+		}
+		select {
+		case <-watchCh:
+		case <-timer.C:
+			return events, nextIndex, nil
+		}
+	}
+}
+
+// Returns the node that an event is about.
+func changedNode(event api.Event) api.FilePath {
+	if event.Child != "" {
+		return event.Child
+	}
+	return event.Filepath
+}
+
+// Add a change to the history, dropping the oldest log entries if it is
+// full. Changes of one log entry are dropped together, so that the history
+// holds either all of an entry's changes or none. Caller must hold s.mu.
+func (s *Store) record(event api.Event) {
+	s.history = append(s.history, api.WatchEvent{Index: s.applying, Event: event})
+	if len(s.history) <= MaxWatchHistory {
+		return
+	}
+	s.historyStart = s.history[0].Index
+	i := 0
+	for i < len(s.history) && s.history[i].Index <= s.historyStart {
+		i++
+	}
+	s.history = s.history[i:]
+}
+
+// Make the changes of the command just applied visible to watchers, and
+// wake them up.
+func (s *Store) wakeWatchers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastIndex = s.applying
+	close(s.watchCh)
+	s.watchCh = make(chan struct{})
+}
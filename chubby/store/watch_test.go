@@ -0,0 +1,136 @@
+package store
+
+import (
+	"cos518project/chubby/api"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "mkdir", Key: "/ls/a"})          // 1
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/a/f"})          // 2
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/b"})            // 3
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/a/f"})          // 4
+	s.mustCommit(t, &command{Op: "setlock", Key: "/ls/x", Lock: &LockState{}})  // 5, no change
+
+	tests := []struct {
+		name      string
+		prefix    string
+		fromIndex uint64
+		want      []uint64  // Log indexes of the events returned.
+	}{
+		{name: "everything", prefix: "/ls", fromIndex: 0, want: []uint64{1, 2, 3, 4}},
+		{name: "prefix", prefix: "/ls/a/", fromIndex: 0, want: []uint64{2, 4}},
+		{name: "resume", prefix: "/ls", fromIndex: 2, want: []uint64{3, 4}},
+		{name: "up to date", prefix: "/ls", fromIndex: 5, want: []uint64{}},
+		{name: "no match", prefix: "/ls/c", fromIndex: 0, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, nextIndex, err := s.Watch(tt.prefix, tt.fromIndex, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nextIndex != 5 {
+				t.Errorf("got next index %d, want 5", nextIndex)
+			}
+			got := []uint64{}
+			for _, e := range events {
+				got = append(got, e.Index)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got indexes %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got indexes %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchWakesUp(t *testing.T) {
+	s := newTestStore()
+	done := make(chan []api.WatchEvent)
+	go func() {
+		events, _, _ := s.Watch("/ls/", 0, 10 * time.Second)
+		done <- events
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/f"})
+	select {
+	case events := <-done:
+		if len(events) != 1 || events[0].Event.Child != "/ls/f" {
+			t.Errorf("got %+v, want the creation of /ls/f", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not wake up")
+	}
+}
+
+// A watcher must not be told that an index was reached before all of its
+// changes are recorded, or it would resume past them.
+func TestWatchDuringApply(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/f"})  // 1
+
+	// Record the changes of entry 2 as Apply does, without finishing it.
+	s.mu.Lock()
+	s.applying = 2
+	s.notifyModified("/ls/f")
+	s.mu.Unlock()
+
+	events, nextIndex, err := s.Watch("/ls/", 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 || nextIndex != 1 {
+		t.Fatalf("during apply: got %+v and next index %d, want nothing and 1", events, nextIndex)
+	}
+
+	s.wakeWatchers()
+	events, nextIndex, err = s.Watch("/ls/", nextIndex, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Index != 2 || nextIndex != 2 {
+		t.Errorf("after apply: got %+v and next index %d, want the change at 2", events, nextIndex)
+	}
+}
+
+func TestWatchCompaction(t *testing.T) {
+	s := newTestStore()
+	s.mustCommit(t, &command{Op: "set", Key: "/ls/f"})
+	// One entry with two changes, which must be dropped together.
+	s.mustCommit(t, &command{Op: "txn", Ops: []api.TxnOp{
+		{Type: api.TXN_CREATE, Filepath: "/ls/g"},
+		{Type: api.TXN_CREATE, Filepath: "/ls/h"},
+	}})
+	for i := 0; i < MaxWatchHistory - 1; i++ {
+		s.mustCommit(t, &command{Op: "set", Key: "/ls/f"})
+	}
+
+	// Two changes too many were made: entry 1 went first, then both
+	// changes of entry 2, although dropping one would have been enough.
+	s.mu.Lock()
+	historyStart, oldest := s.historyStart, s.history[0].Index
+	s.mu.Unlock()
+	if historyStart != 2 || oldest != 3 {
+		t.Fatalf("got history start %d and oldest change at %d, want 2 and 3", historyStart, oldest)
+	}
+
+	_, _, err := s.Watch("/ls/", 1, time.Millisecond)
+	if compacted, ok := err.(*CompactedError); !ok || compacted.Oldest != 2 {
+		t.Errorf("got %v, want *CompactedError with oldest index 2", err)
+	}
+	events, _, err := s.Watch("/ls/", 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != MaxWatchHistory - 1 || events[0].Index != 3 {
+		t.Errorf("from index 0: got %d changes starting at %d, want %d starting at 3", len(events), events[0].Index, MaxWatchHistory - 1)
+	}
+}